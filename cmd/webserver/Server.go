@@ -136,7 +136,9 @@ func GeneralInformation(w http.ResponseWriter, r *http.Request) {
     </html>`)
 }
 
-func main() {
+// newRouter registers the pages, the user API and the API description. The chat
+// routes are added to the returned API by ChatAppMain.
+func newRouter() (*mux.Router, *API) {
 	r := mux.NewRouter()
 
 	// Register routes
@@ -149,17 +151,34 @@ func main() {
 	r.HandleFunc("/login", LoginPage)
 	r.HandleFunc("/restful/login", LoginUser).Methods("POST")
 	r.HandleFunc("/send", SendMessagePage)
-	r.HandleFunc("/restful/send", SendMessage).Methods("POST")
+
+	// JSON endpoints live under /api/v1, their old paths stay as deprecated aliases
+	api := NewAPI(r)
 
 	// Register routes from restful.go
-	RegisterRoutes(r)
+	RegisterRoutes(api)
+
+	// API description, every route of the server has to be listed in openapi.go
+	r.HandleFunc("/openapi.json", OpenAPIHandler).Methods("GET")
+	r.HandleFunc("/docs", DocsHandler).Methods("GET")
+	return r, api
+}
+
+func main() {
+	r, api := newRouter()
 
 	port := "8080"
-	fmt.Printf("Server starting on port %s...\n", port)
+	grpcPort := "9090"
+	fmt.Printf("Server starting on port %s, gRPC on port %s...\n", port, grpcPort)
 
 	connectDB()
 
-	ChatAppMain(*r, port)
+	ChatAppMain(api, port, grpcPort)
+
+	// Only now that the chat routes are registered too
+	for _, route := range CheckOpenAPICoverage(r) {
+		fmt.Println("Route missing from the OpenAPI document:", route)
+	}
 
 	log.Fatal(http.ListenAndServe(":"+port, r)) // Use the router here
 
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+)
+
+/*
+SQLAuditLog is an AuditStore that keeps the admin actions of all instances in
+MySQL, so the trail survives restarts.
+
+It expects the following table:
+
+	CREATE TABLE audit_log (
+	    id         BIGINT       AUTO_INCREMENT PRIMARY KEY,
+	    created_at DATETIME(6)  NOT NULL,
+	    admin      VARCHAR(64)  NOT NULL,
+	    action     VARCHAR(64)  NOT NULL,
+	    target     VARCHAR(255) NOT NULL,
+	    detail     TEXT         NOT NULL
+	);
+
+Behavior:
+  - Entries are never updated or deleted by the server.
+  - Entries come back in insertion order by id, newest first.
+  - The data source name needs parseTime=true so created_at scans into a time.Time.
+*/
+type SQLAuditLog struct {
+	DB *sql.DB
+}
+
+// Record implements AuditStore
+func (l SQLAuditLog) Record(entry AuditEntry) error {
+	_, err := l.DB.Exec("INSERT INTO audit_log (created_at, admin, action, target, detail) VALUES (?, ?, ?, ?, ?)",
+		entry.Time, entry.Admin, entry.Action, entry.Target, entry.Detail)
+	return err
+}
+
+// Entries implements AuditStore
+func (l SQLAuditLog) Entries(limit int) ([]AuditEntry, error) {
+	rows, err := l.DB.Query("SELECT created_at, admin, action, target, detail FROM audit_log ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.Time, &entry.Admin, &entry.Action, &entry.Target, &entry.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
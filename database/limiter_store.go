@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+/*
+SQLLimiterStore is a LimiterStore that keeps the token buckets in MySQL, so that
+several server instances enforce the same limits.
+
+It expects the following table:
+
+	CREATE TABLE rate_limits (
+	    bucket_key VARCHAR(255) PRIMARY KEY,
+	    tokens     DOUBLE       NOT NULL,
+	    updated_at DATETIME(6)  NOT NULL
+	);
+
+Behavior:
+  - Every Take runs in its own transaction and locks the bucket rows with SELECT ... FOR UPDATE,
+    in key order so concurrent calls for overlapping buckets can't deadlock.
+  - Buckets that do not exist yet are created full.
+  - If one bucket is empty none of them loses a token.
+  - The data source name needs parseTime=true so updated_at scans into a time.Time.
+*/
+type SQLLimiterStore struct {
+	DB *sql.DB
+}
+
+// Take implements LimiterStore
+func (s SQLLimiterStore) Take(buckets ...Bucket) (bool, time.Duration, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	ordered := append([]Bucket(nil), buckets...)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Key < ordered[j].Key })
+
+	now := time.Now()
+	tokens := make([]float64, len(ordered))
+	last := make([]time.Time, len(ordered))
+	for i, b := range ordered {
+		tokens[i], last[i] = float64(b.Limit.Burst), now
+		err = tx.QueryRow("SELECT tokens, updated_at FROM rate_limits WHERE bucket_key = ? FOR UPDATE", b.Key).Scan(&tokens[i], &last[i])
+		if err != nil && err != sql.ErrNoRows {
+			return false, 0, err
+		}
+	}
+
+	tokens, allowed, wait := takeTokens(tokens, last, now, ordered)
+
+	for i, b := range ordered {
+		_, err = tx.Exec(`INSERT INTO rate_limits (bucket_key, tokens, updated_at) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE tokens = VALUES(tokens), updated_at = VALUES(updated_at)`, b.Key, tokens[i], now)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+
+	return allowed, wait, tx.Commit()
+}
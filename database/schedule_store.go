@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+/*
+SQLScheduleStore is a ScheduleStore that keeps scheduled messages in MySQL, so
+they are still sent after a restart.
+
+It expects the following table:
+
+	CREATE TABLE scheduled_messages (
+	    id            VARCHAR(32)  PRIMARY KEY,
+	    sender_id     VARCHAR(255) NOT NULL,
+	    payload       JSON         NOT NULL,
+	    send_at       DATETIME(6)  NOT NULL,
+	    created_at    DATETIME(6)  NOT NULL,
+	    claimed_until DATETIME(6)  NULL,
+	    attempts      INT          NOT NULL DEFAULT 0,
+	    INDEX (send_at),
+	    INDEX (sender_id)
+	);
+
+An existing table is migrated with:
+
+	ALTER TABLE scheduled_messages
+	    ADD COLUMN claimed_until DATETIME(6) NULL,
+	    ADD COLUMN attempts      INT         NOT NULL DEFAULT 0;
+
+Behavior:
+  - Claim is a single conditional UPDATE, so of several instances only one gets a message.
+  - Update and Cancel check the claim in the same statement, so a message can't change once delivery has started.
+  - The message itself is stored as JSON in payload, so encrypted messages and replies keep all their fields.
+  - The data source name needs parseTime=true so the DATETIME columns scan into a time.Time.
+*/
+type SQLScheduleStore struct {
+	DB *sql.DB
+}
+
+// Save implements ScheduleStore
+func (s SQLScheduleStore) Save(sm ScheduledMessage) error {
+	payload, err := json.Marshal(sm.Message)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec("INSERT INTO scheduled_messages (id, sender_id, payload, send_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		sm.ID, sm.Message.SenderID, payload, sm.SendAt, sm.CreatedAt)
+	return err
+}
+
+// Update implements ScheduleStore
+func (s SQLScheduleStore) Update(sm ScheduledMessage, now time.Time) (bool, error) {
+	payload, err := json.Marshal(sm.Message)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.DB.Exec("UPDATE scheduled_messages SET payload = ?, send_at = ? WHERE id = ? AND (claimed_until IS NULL OR claimed_until <= ?)",
+		payload, sm.SendAt, sm.ID, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Get implements ScheduleStore
+func (s SQLScheduleStore) Get(id string) (ScheduledMessage, bool, error) {
+	list, err := s.query("SELECT id, payload, send_at, created_at, attempts FROM scheduled_messages WHERE id = ?", id)
+	if err != nil || len(list) == 0 {
+		return ScheduledMessage{}, false, err
+	}
+	return list[0], true, nil
+}
+
+// Cancel implements ScheduleStore
+func (s SQLScheduleStore) Cancel(id string, now time.Time) (bool, error) {
+	res, err := s.DB.Exec("DELETE FROM scheduled_messages WHERE id = ? AND (claimed_until IS NULL OR claimed_until <= ?)", id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Delete implements ScheduleStore
+func (s SQLScheduleStore) Delete(id string) (bool, error) {
+	res, err := s.DB.Exec("DELETE FROM scheduled_messages WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Claim implements ScheduleStore
+func (s SQLScheduleStore) Claim(id string, now, until time.Time) (bool, error) {
+	res, err := s.DB.Exec("UPDATE scheduled_messages SET claimed_until = ?, attempts = attempts + 1 WHERE id = ? AND (claimed_until IS NULL OR claimed_until <= ?)",
+		until, id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Due implements ScheduleStore
+func (s SQLScheduleStore) Due(now time.Time) ([]ScheduledMessage, error) {
+	return s.query("SELECT id, payload, send_at, created_at, attempts FROM scheduled_messages WHERE send_at <= ? AND (claimed_until IS NULL OR claimed_until <= ?) ORDER BY send_at", now, now)
+}
+
+// BySender implements ScheduleStore
+func (s SQLScheduleStore) BySender(senderID string) ([]ScheduledMessage, error) {
+	return s.query("SELECT id, payload, send_at, created_at, attempts FROM scheduled_messages WHERE sender_id = ? ORDER BY send_at", senderID)
+}
+
+// query runs a SELECT over scheduled_messages and decodes the rows
+func (s SQLScheduleStore) query(query string, args ...interface{}) ([]ScheduledMessage, error) {
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []ScheduledMessage
+	for rows.Next() {
+		var sm ScheduledMessage
+		var payload []byte
+		if err := rows.Scan(&sm.ID, &payload, &sm.SendAt, &sm.CreatedAt, &sm.Attempts); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &sm.Message); err != nil {
+			return nil, err
+		}
+		list = append(list, sm)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/*
+SQLBroker is a Broker that passes message events between instances through MySQL.
+
+Events are inserted into a table that every instance polls. Subscribers on the
+publishing instance get the event right away; the other instances pick it up
+on their next poll. It expects the following table:
+
+	CREATE TABLE message_events (
+	    id         BIGINT AUTO_INCREMENT PRIMARY KEY,
+	    origin     VARCHAR(32) NOT NULL,
+	    payload    JSON        NOT NULL,
+	    created_at DATETIME(6) NOT NULL
+	);
+
+Behavior:
+  - Publish never waits for the database; inserts are done in order by a background writer.
+  - Polling starts at the newest event, so a fresh instance doesn't replay old messages.
+  - Old rows are not cleaned up by the broker and should be pruned periodically.
+*/
+type SQLBroker struct {
+	db       *sql.DB
+	origin   string
+	local    *MemoryBroker
+	outgoing chan MessageEvent
+}
+
+// NewSQLBroker creates an SQLBroker for the instance origin and starts its
+// writer and a poller checking for new events every interval.
+func NewSQLBroker(db *sql.DB, origin string, interval time.Duration) (*SQLBroker, error) {
+	b := &SQLBroker{
+		db:       db,
+		origin:   origin,
+		local:    NewMemoryBroker(),
+		outgoing: make(chan MessageEvent, 1024),
+	}
+
+	var lastID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM message_events").Scan(&lastID); err != nil {
+		return nil, err
+	}
+
+	go b.write()
+	go b.poll(lastID, interval)
+	return b, nil
+}
+
+// Publish implements Broker
+func (b *SQLBroker) Publish(event MessageEvent) error {
+	b.local.Publish(event)
+
+	select {
+	case b.outgoing <- event:
+		return nil
+	default:
+		return fmt.Errorf("message event queue is full, dropped event for message %s", event.Message.ID)
+	}
+}
+
+// Subscribe implements Broker
+func (b *SQLBroker) Subscribe() (<-chan MessageEvent, func()) {
+	return b.local.Subscribe()
+}
+
+// write inserts published events into the database
+func (b *SQLBroker) write() {
+	for event := range b.outgoing {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			fmt.Println("Broker failed to encode event:", err)
+			continue
+		}
+		_, err = b.db.Exec("INSERT INTO message_events (origin, payload, created_at) VALUES (?, ?, ?)", event.Origin, payload, time.Now())
+		if err != nil {
+			fmt.Println("Broker failed to publish event:", err)
+		}
+	}
+}
+
+// poll forwards events published by other instances to the local subscribers
+func (b *SQLBroker) poll(lastID int64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := b.db.Query("SELECT id, origin, payload FROM message_events WHERE id > ? ORDER BY id", lastID)
+		if err != nil {
+			fmt.Println("Broker failed to poll events:", err)
+			continue
+		}
+
+		for rows.Next() {
+			var event MessageEvent
+			var origin string
+			var payload []byte
+			if err := rows.Scan(&lastID, &origin, &payload); err != nil {
+				fmt.Println("Broker failed to read event:", err)
+				break
+			}
+			// Local subscribers already got our own events when they were published
+			if origin == b.origin {
+				continue
+			}
+			if err := json.Unmarshal(payload, &event); err != nil {
+				fmt.Println("Broker failed to decode event:", err)
+				continue
+			}
+			b.local.Publish(event)
+		}
+		rows.Close()
+	}
+}
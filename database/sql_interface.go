@@ -52,29 +52,28 @@ func InitDB(dataSourceName string) {
 }
 
 /*
-connectDB demonstrates how to establish a database connection locally within a function.
+connectDB connects the global `db` to the MySQL database named by getDBString.
 
-This function uses a connection string to connect to the MySQL database. The connection
-string includes the username, password, host, and database name.
+The connection string includes the username, password, host, and database name.
+Every store that finds `db` set after this call keeps its data in MySQL: users,
+scheduled messages, the message broker, suspensions and the audit log.
 
 Behavior:
-  - Opens a new database connection using a locally defined connection string.
-  - Defers the closing of the database connection to ensure it is closed when the function exits.
+  - Opens the connection pool and assigns it to the global `db`; it stays open while the server runs.
   - Verifies the connection by pinging the database.
   - Prints a success message if the connection is successful.
   - Panics if the connection cannot be established or verified.
 */
 func connectDB() {
+	var err error
 
 	// Define the connection string with the necessary details to connect to the database.
 	// Example format: "username:password@tcp(127.0.0.1:3306)/dbname"
-	db, err := sql.Open("mysql", getDBString())
+	db, err = sql.Open("mysql", getDBString())
 	if err != nil {
 		// Panic is used to stop the program execution and print the error message if the connection fails.
 		panic(err)
 	}
-	// Ensure the database connection is closed when the function exits to avoid connection leaks.
-	defer db.Close()
 
 	// Ping the database to verify that the connection is successful.
 	err = db.Ping()
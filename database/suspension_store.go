@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+/*
+SQLSuspensionStore is a SuspensionStore that keeps suspensions in MySQL next to
+the users, so every instance enforces them and they survive restarts.
+
+It expects the following table:
+
+	CREATE TABLE suspensions (
+	    user_id         VARCHAR(64) PRIMARY KEY,
+	    suspended_until DATETIME(6) NOT NULL
+	);
+
+Behavior:
+  - Suspending a user again replaces the end of their suspension.
+  - Expired suspensions stay in the table until they are lifted; they no longer apply.
+  - The data source name needs parseTime=true so suspended_until scans into a time.Time.
+*/
+type SQLSuspensionStore struct {
+	DB *sql.DB
+}
+
+// Suspend implements SuspensionStore
+func (s SQLSuspensionStore) Suspend(userID string, until time.Time) error {
+	_, err := s.DB.Exec("INSERT INTO suspensions (user_id, suspended_until) VALUES (?, ?) ON DUPLICATE KEY UPDATE suspended_until = VALUES(suspended_until)",
+		userID, until)
+	return err
+}
+
+// Lift implements SuspensionStore
+func (s SQLSuspensionStore) Lift(userID string) (bool, error) {
+	res, err := s.DB.Exec("DELETE FROM suspensions WHERE user_id = ?", userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Until implements SuspensionStore
+func (s SQLSuspensionStore) Until(userID string) (time.Time, bool, error) {
+	var until time.Time
+	err := s.DB.QueryRow("SELECT suspended_until FROM suspensions WHERE user_id = ?", userID).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return until, false, nil
+	}
+	return until, err == nil, err
+}
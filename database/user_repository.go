@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+/*
+SQLUserRepository is a UserRepository that keeps users in MySQL, shared by all
+server instances.
+
+It extends the users table written by the registration form to the following:
+
+	CREATE TABLE users (
+	    id         VARCHAR(64)  PRIMARY KEY,
+	    name       VARCHAR(64)  NOT NULL UNIQUE,
+	    password   VARCHAR(255) NOT NULL DEFAULT '',
+	    role       VARCHAR(32)  NOT NULL DEFAULT 'user',
+	    created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	    version    INT          NOT NULL DEFAULT 1
+	);
+
+An existing table is migrated with:
+
+	ALTER TABLE users
+	    ADD COLUMN role       VARCHAR(32) NOT NULL DEFAULT 'user',
+	    ADD COLUMN created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	    ADD COLUMN version    INT         NOT NULL DEFAULT 1,
+	    ADD UNIQUE (name);
+
+Behavior:
+  - id holds the 26 character ULID of new users; users created before keep
+    their numeric IDs, which the routes still accept, so no data has to change.
+  - password holds the bcrypt hash, an empty hash means the user can't log in.
+  - Create relies on the primary key and the unique name index, a duplicate ID or
+    name is told apart by the key MySQL reports.
+  - Name uniqueness ignoring case relies on the case-insensitive default collation.
+    Names are stored and looked up without surrounding whitespace, so the same names
+    collide as in MemoryUserRepository.
+  - The data source name needs parseTime=true so created_at scans into a time.Time.
+*/
+type SQLUserRepository struct {
+	DB *sql.DB
+}
+
+// mysqlDuplicateKey is the MySQL error number for a violated unique key
+const mysqlDuplicateKey = 1062
+
+// Create implements UserRepository
+func (s SQLUserRepository) Create(user ChatUser) error {
+	_, err := s.DB.Exec("INSERT INTO users (id, name, password, role, created_at, version) VALUES (?, ?, ?, ?, ?, ?)",
+		user.InternData.ID, strings.TrimSpace(user.InternData.Name), user.HashPassword, user.Role, user.InternData.CreatedAt, user.InternData.Version)
+	return userError(err)
+}
+
+// Get implements UserRepository
+func (s SQLUserRepository) Get(id string) (ChatUser, error) {
+	return s.queryOne("SELECT id, name, password, role, created_at, version FROM users WHERE id = ?", id)
+}
+
+// GetByName implements UserRepository
+func (s SQLUserRepository) GetByName(name string) (ChatUser, error) {
+	return s.queryOne("SELECT id, name, password, role, created_at, version FROM users WHERE name = ?", strings.TrimSpace(name))
+}
+
+// Update implements UserRepository
+func (s SQLUserRepository) Update(user ChatUser, expectedVersion int) error {
+	res, err := s.DB.Exec("UPDATE users SET name = ?, password = ?, role = ?, version = ? WHERE id = ? AND version = ?",
+		strings.TrimSpace(user.InternData.Name), user.HashPassword, user.Role, user.InternData.Version, user.InternData.ID, expectedVersion)
+	if err != nil {
+		return userError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// Nothing changed: either the user is gone or the version moved on
+	if _, err := s.Get(user.InternData.ID); err != nil {
+		return err
+	}
+	return ErrVersionConflict
+}
+
+// Delete implements UserRepository
+func (s SQLUserRepository) Delete(id string) error {
+	res, err := s.DB.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return ErrUserNotFound
+}
+
+// List implements UserRepository. Users are ordered by ID.
+func (s SQLUserRepository) List() ([]ChatUser, error) {
+	rows, err := s.DB.Query("SELECT id, name, password, role, created_at, version FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []ChatUser
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, user)
+	}
+	return list, rows.Err()
+}
+
+// queryOne runs a query selecting at most one user
+func (s SQLUserRepository) queryOne(query string, arg interface{}) (ChatUser, error) {
+	user, err := scanUser(s.DB.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChatUser{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// rowScanner is what *sql.Row and *sql.Rows have in common
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a user from a row of id, name, password, role, created_at, version
+func scanUser(row rowScanner) (ChatUser, error) {
+	var user ChatUser
+	err := row.Scan(&user.InternData.ID, &user.InternData.Name, &user.HashPassword, &user.Role,
+		&user.InternData.CreatedAt, &user.InternData.Version)
+	return user, err
+}
+
+// userError maps a violated primary key to ErrUserExists and a violated unique
+// name to ErrNameTaken. MySQL only names the key in the message, like
+// "Duplicate entry '1' for key 'users.PRIMARY'" (or 'PRIMARY' before 8.0).
+func userError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != mysqlDuplicateKey {
+		return err
+	}
+	if strings.HasSuffix(mysqlErr.Message, "PRIMARY'") {
+		return ErrUserExists
+	}
+	return ErrNameTaken
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
@@ -11,30 +12,50 @@ var jwtKey = []byte("your_secret_key") // This should be a secret key, stored se
 
 func IsAdmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
+		if r.Header.Get("Authorization") == "" {
+			WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "Authorization header missing"))
 			return
 		}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		claims, err := ClaimsFromRequest(r)
+		if err != nil {
+			WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "The JWT in the Authorization header is not valid"))
 			return
 		}
 
 		if claims.Role != "admin" {
-			http.Error(w, "Forbidden: Admins only", http.StatusForbidden)
+			WriteProblem(w, r, NewProblem(http.StatusForbidden, "Admins only"))
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// ClaimsFromRequest parses and validates the JWT in the Authorization header
+func ClaimsFromRequest(r *http.Request) (*Claims, error) {
+	return ParseClaims(r.Header.Get("Authorization"))
+}
+
+// ParseClaims parses and validates a JWT, wherever it was sent
+func ParseClaims(tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, errors.New("authorization header missing")
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
 func GenerateJWT(username, role string) (string, error) {
 	expirationTime := time.Now().Add(time.Hour * 24)
 	claims := &Claims{
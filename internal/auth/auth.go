@@ -19,13 +19,11 @@ func HashPassword(password string) (string, error) {
 
 // Login authenticates a user by username and password.
 // If successful, returns a hashed token; otherwise, returns "invalid".
-func Login(cs ChatService, username string, password string) string {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+func Login(cs *ChatService, username string, password string) string {
+	user, err := cs.users.GetByName(username)
 
-	id, found := findValueInMap(cs.users, username)
 	var token = "invalid"
-	if found && password == cs.users[id].Password {
+	if err == nil && CheckPassword(user, password) { // Bots have no password and can't log in
 		// Successful login
 		fmt.Print("Logged in as " + username)
 		token, _ = HashPassword(password) // Create token
@@ -36,14 +34,3 @@ func Login(cs ChatService, username string, password string) string {
 
 	return token
 }
-
-// findValueInMap looks for a user with a specific name in the map.
-// Returns the user ID and a boolean indicating if found.
-func findValueInMap(m map[string]ChatUser, targetValue string) (string, bool) {
-	for key, value := range m {
-		if value.InternData.Name == targetValue {
-			return key, true // User found
-		}
-	}
-	return "", false // User not found
-}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SuspensionStore keeps the end of every user's suspension. The SQL implementation
+// shares suspensions between instances and keeps them across restarts.
+type SuspensionStore interface {
+	Suspend(userID string, until time.Time) error
+	// Lift removes the suspension of a user and reports whether there was one.
+	Lift(userID string) (bool, error)
+	// Until returns the end of a user's suspension, which may be in the past.
+	Until(userID string) (time.Time, bool, error)
+}
+
+// MemorySuspensionStore is a SuspensionStore for a single server instance.
+type MemorySuspensionStore struct {
+	mu    sync.Mutex
+	until map[string]time.Time // User ID -> end of the suspension
+}
+
+// NewMemorySuspensionStore creates an empty MemorySuspensionStore
+func NewMemorySuspensionStore() *MemorySuspensionStore {
+	return &MemorySuspensionStore{until: make(map[string]time.Time)}
+}
+
+// Suspend implements SuspensionStore
+func (s *MemorySuspensionStore) Suspend(userID string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.until[userID] = until
+	return nil
+}
+
+// Lift implements SuspensionStore
+func (s *MemorySuspensionStore) Lift(userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.until[userID]
+	delete(s.until, userID)
+	return ok, nil
+}
+
+// Until implements SuspensionStore
+func (s *MemorySuspensionStore) Until(userID string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.until[userID]
+	return until, ok, nil
+}
+
+// Suspensions keeps track of users who are not allowed to send messages.
+type Suspensions struct {
+	Store SuspensionStore
+}
+
+// suspensions applies to every message sending endpoint
+var suspensions = &Suspensions{Store: NewMemorySuspensionStore()}
+
+// Suspend stops a user from sending messages until the given time
+func (s *Suspensions) Suspend(userID string, until time.Time) error {
+	return s.Store.Suspend(userID, until)
+}
+
+// Lift ends the suspension of a user. Returns false if there was none.
+func (s *Suspensions) Lift(userID string) (bool, error) {
+	return s.Store.Lift(userID)
+}
+
+// Until returns the end of a user's suspension, if they are currently suspended
+func (s *Suspensions) Until(userID string) (time.Time, bool) {
+	until, ok, err := s.Store.Until(userID)
+	if err != nil {
+		// Don't stop everybody from sending because the store is unavailable
+		fmt.Println("Suspension store error:", err)
+		return time.Time{}, false
+	}
+	return until, ok && time.Now().Before(until)
+}
+
+// Check returns an error if the user is currently suspended
+func (s *Suspensions) Check(userID string) error {
+	if until, suspended := s.Until(userID); suspended {
+		return errors.New("Sender is suspended until " + until.Format(time.RFC1123))
+	}
+	return nil
+}
+
+// SearchMessages returns the chat messages and the rows of the messages table
+// matching all given criteria, oldest first. Empty criteria match everything;
+// query matches the content ignoring case.
+func (cs *ChatService) SearchMessages(query, senderID, receiverID string, limit int) ([]Message, error) {
+	found := cs.searchChat(query, senderID, receiverID, limit)
+	stored, err := searchStoredMessages(query, senderID, receiverID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	found = append(found, stored...)
+	sort.SliceStable(found, func(i, j int) bool { return found[i].TimeStamp.Before(found[j].TimeStamp) })
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+// searchChat is SearchMessages for the messages of the chat service
+func (cs *ChatService) searchChat(query, senderID, receiverID string, limit int) []Message {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	// Narrow the search down with the indexes where possible
+	candidates := cs.messages
+	if receiverID != "" {
+		candidates = cs.messagesAt(cs.inbox[receiverID])
+	} else if senderID != "" {
+		candidates = cs.messagesAt(cs.sent[senderID])
+	}
+
+	query = strings.ToLower(query)
+	var found []Message
+	for _, msg := range candidates {
+		if !msg.Deleted &&
+			(senderID == "" || msg.SenderID == senderID) &&
+			(receiverID == "" || msg.ReceiverID == receiverID) &&
+			(query == "" || strings.Contains(strings.ToLower(msg.Message), query)) {
+			found = append(found, msg)
+		}
+		if limit > 0 && len(found) == limit {
+			break
+		}
+	}
+	return found
+}
+
+/*
+searchStoredMessages is SearchMessages for the rows of the messages table, which
+holds the messages of the send form from before it went through the chat service.
+
+It expects the following table:
+
+	CREATE TABLE messages (
+	    id          VARCHAR(32)  PRIMARY KEY,
+	    sender_id   VARCHAR(255) NOT NULL,
+	    receiver_id VARCHAR(255) NOT NULL,
+	    message     TEXT         NOT NULL,
+	    timestamp   DATETIME(6)  NOT NULL,
+	    INDEX (sender_id),
+	    INDEX (receiver_id),
+	    INDEX (timestamp)
+	);
+
+An existing table with a numeric id is migrated with:
+
+	ALTER TABLE messages MODIFY id VARCHAR(32) NOT NULL;
+
+Behavior:
+  - No new rows are written, the send form delivers through SendChecked.
+  - id holds a ULID like the chat messages, so admins find and delete both kinds by ID;
+    the numeric IDs of older rows keep working.
+  - Admin search, deletion and export work on this table as well; the retention sweeper leaves it alone.
+*/
+func searchStoredMessages(query, senderID, receiverID string, limit int) ([]Message, error) {
+	if db == nil {
+		return nil, nil
+	}
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if senderID != "" {
+		where = append(where, "sender_id = ?")
+		args = append(args, senderID)
+	}
+	if receiverID != "" {
+		where = append(where, "receiver_id = ?")
+		args = append(args, receiverID)
+	}
+	if query != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(query))
+		where = append(where, "LOWER(message) LIKE ?")
+		args = append(args, "%"+escaped+"%")
+	}
+	sqlQuery := "SELECT id, sender_id, receiver_id, message, timestamp FROM messages WHERE " + strings.Join(where, " AND ") + " ORDER BY timestamp"
+	if limit > 0 {
+		sqlQuery += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Message, &msg.TimeStamp); err != nil {
+			return nil, err
+		}
+		found = append(found, msg)
+	}
+	return found, rows.Err()
+}
+
+// DeleteMessage removes a chat message or a row of the messages table. A chat message
+// that has replies stays as an empty placeholder marked Deleted, so the replies keep
+// their place in the thread. Returns false if the message does not exist.
+func (cs *ChatService) DeleteMessage(id string) (bool, error) {
+	if cs.deleteChatMessage(id) {
+		return true, nil
+	}
+	return deleteStoredMessage(id)
+}
+
+// deleteChatMessage is DeleteMessage for the messages of the chat service
+func (cs *ChatService) deleteChatMessage(id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	pos, ok := cs.byID[id]
+	if !ok || cs.messages[pos].Deleted {
+		return false
+	}
+	if len(cs.replies[id]) > 0 {
+		msg := &cs.messages[pos]
+		*msg = Message{ID: msg.ID, SenderID: msg.SenderID, ReceiverID: msg.ReceiverID, TimeStamp: msg.TimeStamp, ReplyTo: msg.ReplyTo, Deleted: true}
+		return true
+	}
+	cs.messages = append(cs.messages[:pos], cs.messages[pos+1:]...)
+	cs.reindex()
+	return true
+}
+
+// deleteStoredMessage is DeleteMessage for the rows of the messages table.
+// Rows written by the send form have no replies.
+func deleteStoredMessage(id string) (bool, error) {
+	if db == nil {
+		return false, nil
+	}
+	res, err := db.Exec("DELETE FROM messages WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UserActivity summarizes what a user has been doing in the chat.
+type UserActivity struct {
+	UserID         string
+	Name           string
+	MessagesSent   int
+	MessagesRecv   int
+	Conversations  int        // Number of different users they exchanged messages with
+	FirstMessageAt *time.Time `json:",omitempty"`
+	LastMessageAt  *time.Time `json:",omitempty"`
+	PendingReview  int        // Messages of theirs waiting in the review queue
+	SuspendedUntil *time.Time `json:",omitempty"`
+	LegalHold      bool
+}
+
+// Activity builds the activity summary of a user
+func (cs *ChatService) Activity(userID string) (UserActivity, bool) {
+	user, err := cs.users.Get(userID)
+	if err != nil {
+		return UserActivity{}, false
+	}
+
+	cs.mu.RLock()
+
+	activity := UserActivity{UserID: userID, Name: user.InternData.Name}
+	partners := make(map[string]bool)
+	note := func(msg Message) {
+		if activity.FirstMessageAt == nil || msg.TimeStamp.Before(*activity.FirstMessageAt) {
+			t := msg.TimeStamp
+			activity.FirstMessageAt = &t
+		}
+		if activity.LastMessageAt == nil || msg.TimeStamp.After(*activity.LastMessageAt) {
+			t := msg.TimeStamp
+			activity.LastMessageAt = &t
+		}
+	}
+	for _, pos := range cs.inbox[userID] {
+		msg := cs.messages[pos]
+		activity.MessagesRecv++
+		partners[msg.SenderID] = true
+		note(msg)
+	}
+	for _, pos := range cs.sent[userID] {
+		msg := cs.messages[pos]
+		activity.MessagesSent++
+		partners[msg.ReceiverID] = true
+		note(msg)
+	}
+	cs.mu.RUnlock()
+
+	delete(partners, userID)
+	activity.Conversations = len(partners)
+	for _, item := range moderation.Queue.List() {
+		if item.Message.SenderID == userID {
+			activity.PendingReview++
+		}
+	}
+	if until, ok := suspensions.Until(userID); ok {
+		activity.SuspendedUntil = &until
+	}
+	for _, hold := range retention.Holds() {
+		if hold.UserID == userID {
+			activity.LegalHold = true
+		}
+	}
+	return activity, true
+}
+
+// HTTP Handlers (all admin only)
+
+// AdminListMessagesHandler lists and searches all messages.
+// Supports ?q=, ?sender=, ?receiver= and ?limit=.
+func (cs *ChatService) AdminListMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	messages, err := cs.SearchMessages(q.Get("q"), q.Get("sender"), q.Get("receiver"), limit)
+	if err != nil {
+		fmt.Println("Searching the messages table failed:", err)
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error searching messages"))
+		return
+	}
+	audit(r, "search_messages", "", r.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.withReplyCounts(messages))
+}
+
+// AdminDeleteMessageHandler deletes any message
+func (cs *ChatService) AdminDeleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	deleted, err := cs.DeleteMessage(id)
+	if err != nil {
+		fmt.Println("Deleting from the messages table failed:", err)
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error deleting message"))
+		return
+	}
+	if !deleted {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Message not found"))
+		return
+	}
+
+	audit(r, "delete_message", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SuspendUserHandler stops a user from sending messages for a number of seconds
+func SuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Seconds int64
+		Reason  string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if req.Seconds <= 0 {
+		WriteProblem(w, r, ValidationProblem([]FieldError{{Field: "Seconds", Message: "must be positive"}}))
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	duration := time.Duration(req.Seconds) * time.Second
+	if err := suspensions.Suspend(id, time.Now().Add(duration)); err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error saving suspension"))
+		return
+	}
+
+	audit(r, "suspend_user", id, duration.String()+": "+req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LiftSuspensionHandler lets a suspended user send messages again
+func LiftSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	lifted, err := suspensions.Lift(id)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error lifting suspension"))
+		return
+	}
+	if !lifted {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "User is not suspended"))
+		return
+	}
+
+	audit(r, "lift_suspension", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UserActivityHandler returns the activity summary of a user
+func (cs *ChatService) UserActivityHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	activity, ok := cs.Activity(id)
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "User not found"))
+		return
+	}
+
+	audit(r, "view_activity", id, "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activity)
+}
+
+// SetRoleHandler changes the role of a user, which decides the announcements they get
+func (cs *ChatService) SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if strings.TrimSpace(req.Role) == "" {
+		WriteProblem(w, r, ValidationProblem([]FieldError{{Field: "Role", Message: "is required"}}))
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if !cs.SetRole(id, req.Role) {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "User not found"))
+		return
+	}
+
+	audit(r, "set_role", id, req.Role)
+	w.WriteHeader(http.StatusNoContent)
+}
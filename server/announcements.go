@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SystemSenderID is the sender of messages that come from the server itself
+const SystemSenderID = "system"
+
+// dismissCookie holds the IDs of the announcements a browser has dismissed
+const dismissCookie = "dismissed_announcements"
+
+// Announcement is a message an admin broadcasts to all users, or to the users of some roles.
+type Announcement struct {
+	ID         string
+	Text       string
+	Roles      []string `json:",omitempty"` // Roles that get the announcement, empty means everyone
+	Author     string   // Name of the admin who published it
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time `json:",omitempty"` // After this the banner is no longer shown
+	Recipients int        // Number of inboxes the announcement was delivered to
+}
+
+// Active reports whether the announcement has not expired yet
+func (a Announcement) Active() bool {
+	return a.ExpiresAt == nil || time.Now().Before(*a.ExpiresAt)
+}
+
+// ForRole reports whether users of the given role are in the audience
+func (a Announcement) ForRole(role string) bool {
+	if len(a.Roles) == 0 {
+		return true
+	}
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Announcements keeps every published announcement.
+type Announcements struct {
+	mu   sync.Mutex
+	byID map[string]Announcement
+}
+
+// announcements holds the announcements shown on the home page
+var announcements = &Announcements{byID: make(map[string]Announcement)}
+
+// Add stores a new announcement and assigns its ID
+func (as *Announcements) Add(a Announcement) Announcement {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	a.ID = NewID()
+	as.byID[a.ID] = a
+	return a
+}
+
+// Update replaces a stored announcement
+func (as *Announcements) Update(a Announcement) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.byID[a.ID] = a
+}
+
+// Withdraw removes an announcement so it is no longer shown.
+// Messages already delivered stay in the inboxes. Returns false if it does not exist.
+func (as *Announcements) Withdraw(id string) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	_, ok := as.byID[id]
+	delete(as.byID, id)
+	return ok
+}
+
+// List returns the announcements, newest first. activeOnly leaves out expired ones.
+func (as *Announcements) List(activeOnly bool) []Announcement {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	list := make([]Announcement, 0, len(as.byID))
+	for _, a := range as.byID {
+		if !activeOnly || a.Active() {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Announce delivers an announcement as a system message to the inbox of every
+// user in its audience and notifies them. The audience is picked by the stored
+// role of the users, like the banner. Bots are left out.
+// Returns the number of users it was delivered to.
+func (cs *ChatService) Announce(a Announcement) int {
+	all, err := cs.users.List()
+	if err != nil {
+		fmt.Println("Listing users for announcement failed:", err)
+		return 0
+	}
+
+	var msgs []Message
+	for _, user := range all {
+		id := user.InternData.ID
+		if !cs.IsBot(id) && a.ForRole(user.Role) {
+			msg := CreateMessage(SystemSenderID, id, a.Text)
+			msg.ID = NewID()
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ReceiverID < msgs[j].ReceiverID })
+
+	// Only storing the messages needs the lock
+	cs.mu.Lock()
+	for _, msg := range msgs {
+		cs.messages = append(cs.messages, msg)
+		cs.indexMessage(len(cs.messages) - 1)
+	}
+	cs.mu.Unlock()
+
+	for _, msg := range msgs {
+		if err := cs.broker.Publish(MessageEvent{Origin: instanceID, Message: msg}); err != nil {
+			fmt.Println("Publishing announcement failed:", err)
+		}
+		notifications.Notify(Notification{
+			UserID:    msg.ReceiverID,
+			Kind:      NotifyAnnouncement,
+			Text:      a.Text,
+			MessageID: msg.ID,
+		})
+	}
+	fmt.Printf("Announcement %s delivered to %d users\n", a.ID, len(msgs))
+	return len(msgs)
+}
+
+// audienceRole returns the stored role of the user whose JWT r carries, the role
+// Announce picks the audience by. It is empty without a JWT or for unknown users.
+func audienceRole(r *http.Request) string {
+	claims, err := ClaimsFromRequest(r)
+	if err != nil {
+		return ""
+	}
+	user, err := userRepo.GetByName(claims.Username)
+	if err != nil {
+		return ""
+	}
+	return user.Role
+}
+
+// dismissedAnnouncements returns the IDs of the announcements dismissed in the browser making r
+func dismissedAnnouncements(r *http.Request) map[string]bool {
+	dismissed := make(map[string]bool)
+	if cookie, err := r.Cookie(dismissCookie); err == nil {
+		for _, id := range strings.Split(cookie.Value, ".") {
+			dismissed[id] = true
+		}
+	}
+	return dismissed
+}
+
+// announcementBanner renders the active announcements that were not dismissed yet.
+// Without a JWT only the announcements for everyone are shown.
+func announcementBanner(r *http.Request) string {
+	role := audienceRole(r)
+	dismissed := dismissedAnnouncements(r)
+
+	var banner strings.Builder
+	for _, a := range announcements.List(true) {
+		if dismissed[a.ID] || (len(a.Roles) > 0 && (role == "" || !a.ForRole(role))) {
+			continue
+		}
+		banner.WriteString(`<div class="announcement"><form action="` + apiV1Prefix + `/announcements/` + a.ID + `/dismiss" method="post">` +
+			html.EscapeString(a.Text) + ` <input type="submit" value="Dismiss"></form></div>`)
+	}
+	return banner.String()
+}
+
+// HTTP Handlers
+
+// PublishAnnouncementHandler publishes an announcement and delivers it (admin only).
+// The body carries Text and optionally Roles and ExpiresAt.
+func (cs *ChatService) PublishAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text      string
+		Roles     []string
+		ExpiresAt *time.Time
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		WriteProblem(w, r, ValidationProblem([]FieldError{{Field: "Text", Message: "is required"}}))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "ExpiresAt must be in the future"))
+		return
+	}
+
+	author := ""
+	if claims, err := ClaimsFromRequest(r); err == nil {
+		author = claims.Username
+	}
+	a := announcements.Add(Announcement{
+		Text:      req.Text,
+		Roles:     req.Roles,
+		Author:    author,
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	})
+	a.Recipients = cs.Announce(a)
+	announcements.Update(a)
+
+	audit(r, "publish_announcement", a.ID, req.Text)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// ListAnnouncementsHandler lists all announcements including expired ones (admin only)
+func ListAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(announcements.List(false))
+}
+
+// WithdrawAnnouncementHandler stops showing an announcement (admin only)
+func WithdrawAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !announcements.Withdraw(id) {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Announcement not found"))
+		return
+	}
+
+	audit(r, "withdraw_announcement", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ActiveAnnouncementsHandler lists the announcements that have not expired
+// and are meant for the caller
+func ActiveAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	role := audienceRole(r)
+
+	active := []Announcement{}
+	for _, a := range announcements.List(true) {
+		if len(a.Roles) == 0 || (role != "" && a.ForRole(role)) {
+			active = append(active, a)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+// DismissAnnouncementHandler hides an announcement from the home page banner of
+// this browser and sends it back to the home page
+func DismissAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	dismissed := dismissedAnnouncements(r)
+	dismissed[id] = true
+
+	// Only keep announcements that still exist, so the cookie doesn't grow forever
+	var ids []string
+	for _, a := range announcements.List(true) {
+		if dismissed[a.ID] {
+			ids = append(ids, a.ID)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     dismissCookie,
+		Value:    strings.Join(ids, "."),
+		Path:     "/",
+		MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Path prefixes of the API versions
+const (
+	apiV1Prefix = "/api/v1"
+	apiV2Prefix = "/api/v2"
+)
+
+// When the unversioned API paths were deprecated, and when they stop answering
+var (
+	legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset       = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// API registers the JSON endpoints of the server. Every endpoint lives under /api/v1
+// and keeps answering at its old unversioned path as a deprecated alias. Single routes
+// can be replaced in /api/v2, requests for every other /api/v2 path are served by v1.
+type API struct {
+	root *mux.Router // Router the pages and the deprecated aliases are registered on
+	v1   *mux.Router
+	v2   *mux.Router
+}
+
+// NewAPI mounts /api/v1 and /api/v2 on r
+func NewAPI(r *mux.Router) *API {
+	api := &API{
+		root: r,
+		v1:   r.PathPrefix(apiV1Prefix).Subrouter(),
+		v2:   r.PathPrefix(apiV2Prefix).Subrouter(),
+	}
+
+	// Whatever v2 doesn't have itself falls through to v1
+	fallback := http.HandlerFunc(api.serveV2FromV1)
+	api.v2.NotFoundHandler = fallback
+	api.v2.MethodNotAllowedHandler = fallback
+	return api
+}
+
+// Handle registers h for method and path under /api/v1, and at path itself as a deprecated alias
+func (api *API) Handle(method, path string, h http.Handler) {
+	api.v1.Handle(path, h).Methods(method)
+	api.root.Handle(path, deprecatedAlias(h)).Methods(method)
+}
+
+// HandleFunc is Handle for a handler function
+func (api *API) HandleFunc(method, path string, f func(http.ResponseWriter, *http.Request)) {
+	api.Handle(method, path, http.HandlerFunc(f))
+}
+
+// HandleV1 registers h for method and path under /api/v1 only. Endpoints added after
+// the unversioned paths were deprecated get no alias, /login would clash with the pages anyway.
+func (api *API) HandleV1(method, path string, h http.Handler) {
+	api.v1.Handle(path, h).Methods(method)
+}
+
+// HandleV2 registers h for method and path under /api/v2, replacing the v1 route there.
+// The v1 route and its alias stay as they are.
+func (api *API) HandleV2(method, path string, h http.Handler) {
+	api.v2.Handle(path, h).Methods(method)
+}
+
+// HandleUnversioned registers h for method and path outside of /api, for endpoints
+// like /graphql that evolve without version numbers
+func (api *API) HandleUnversioned(method, path string, h http.Handler) {
+	api.root.Handle(path, h).Methods(method)
+}
+
+// serveV2FromV1 serves a request for /api/v2 that has no v2 route of its own from /api/v1
+func (api *API) serveV2FromV1(w http.ResponseWriter, r *http.Request) {
+	v1 := r.Clone(r.Context())
+	v1.URL.Path = apiV1Prefix + strings.TrimPrefix(r.URL.Path, apiV2Prefix)
+	if r.URL.RawPath != "" {
+		v1.URL.RawPath = apiV1Prefix + strings.TrimPrefix(r.URL.RawPath, apiV2Prefix)
+	}
+	api.v1.ServeHTTP(w, v1)
+}
+
+// deprecatedAlias serves an unversioned path. Responses carry a Deprecation header
+// (RFC 9745), a Sunset header (RFC 8594) and a Link to the /api/v1 path replacing it.
+// After the sunset the alias answers 410 Gone.
+func deprecatedAlias(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedAt.Unix(), 10))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Add("Link", "<"+apiV1Prefix+r.URL.Path+`>; rel="successor-version"`)
+
+		if time.Now().After(legacySunset) {
+			WriteProblem(w, r, NewProblem(http.StatusGone, "This path was retired, use "+apiV1Prefix+r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
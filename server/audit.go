@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one action taken by an admin.
+type AuditEntry struct {
+	Time   time.Time
+	Admin  string // Name of the admin from their JWT
+	Action string // What was done, e.g. "delete_message"
+	Target string // ID of the affected user or message
+	Detail string // Free form details like a reason or duration
+}
+
+// AuditStore is an append-only list of admin actions. The SQL implementation keeps
+// the actions of all instances across restarts.
+type AuditStore interface {
+	Record(entry AuditEntry) error
+	// Entries returns the limit most recent entries, newest first.
+	Entries(limit int) ([]AuditEntry, error)
+}
+
+// maxAuditEntries is how many entries the audit log returns at most, and how
+// many MemoryAuditLog keeps.
+const maxAuditEntries = 10000
+
+// MemoryAuditLog is an AuditStore for a single server instance. It keeps the
+// maxAuditEntries most recent entries and forgets them on restart.
+type MemoryAuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// auditLog records every admin action of this server
+var auditLog AuditStore = &MemoryAuditLog{}
+
+// Record implements AuditStore
+func (l *MemoryAuditLog) Record(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) >= maxAuditEntries {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-maxAuditEntries+1:]...)
+	}
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// Entries implements AuditStore
+func (l *MemoryAuditLog) Entries(limit int) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit > len(l.entries) {
+		limit = len(l.entries)
+	}
+	entries := make([]AuditEntry, 0, limit)
+	for i := len(l.entries) - 1; i >= len(l.entries)-limit; i-- {
+		entries = append(entries, l.entries[i])
+	}
+	return entries, nil
+}
+
+// audit records an admin action taken through the request r
+func audit(r *http.Request, action, target, detail string) {
+	admin := ""
+	if claims, err := ClaimsFromRequest(r); err == nil {
+		admin = claims.Username
+	}
+
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Admin:  admin,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	fmt.Printf("Audit: %s %s %s %s\n", entry.Admin, entry.Action, entry.Target, entry.Detail)
+	if err := auditLog.Record(entry); err != nil {
+		fmt.Println("Audit log error:", err)
+	}
+}
+
+// HTTP Handlers
+
+// GetAuditLogHandler returns the audit trail, newest first (admin only).
+// ?limit=n returns only the n most recent entries, at most maxAuditEntries.
+func GetAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > maxAuditEntries {
+		limit = maxAuditEntries
+	}
+
+	entries, err := auditLog.Entries(limit)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error loading audit log"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
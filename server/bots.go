@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Bot is an automated chat participant. Bots are registered as users of the
+// ChatService and get every message addressed to them.
+type Bot interface {
+	HandleMessage(ctx *BotContext, msg Message)
+}
+
+// BotContext is handed to a bot for every message it receives.
+type BotContext struct {
+	CS    *ChatService
+	BotID string // User ID of the bot
+}
+
+// Reply sends a message from the bot through the normal send path. Bots are
+// rate limited with the "bot" role, separately for each user they answer, and
+// their messages are moderated like any other.
+func (ctx *BotContext) Reply(receiverID, text string) error {
+	if allowed, wait := sendLimiter.Take(ctx.BotID, receiverID, "bot"); !allowed {
+		return fmt.Errorf("bot %s is rate limited, retry in %s", ctx.BotID, wait.Round(time.Second))
+	}
+	return ctx.CS.SendModerated(CreateMessage(ctx.BotID, receiverID, text))
+}
+
+// RegisterBot registers a bot as a chat user, so messages can be sent to it
+func (cs *ChatService) RegisterBot(id, name string, bot Bot) error {
+	if err := cs.registerUser(id, name, "", "bot"); err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.bots[id] = bot
+	return nil
+}
+
+// IsBot reports whether the user with the given ID is a registered bot. Clients
+// can't send in the name of a bot, only the bot itself replies through BotContext.
+func (cs *ChatService) IsBot(id string) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	_, ok := cs.bots[id]
+	return ok
+}
+
+// dispatchToBot hands msg to the bot it is addressed to, if any. Messages sent by
+// bots are never dispatched, so two bots can't keep answering each other.
+// The bot runs in its own goroutine.
+func (cs *ChatService) dispatchToBot(msg Message) {
+	cs.mu.RLock()
+	bot, ok := cs.bots[msg.ReceiverID]
+	_, fromBot := cs.bots[msg.SenderID]
+	cs.mu.RUnlock()
+	if !ok || fromBot {
+		return
+	}
+	go bot.HandleMessage(&BotContext{CS: cs, BotID: msg.ReceiverID}, msg)
+}
+
+// Slash commands
+
+// Command is a slash command like /whois.
+type Command struct {
+	Name    string // Name without the leading slash
+	Usage   string // Arguments, shown by /help
+	Help    string // One line description, shown by /help
+	Handler func(ctx *BotContext, msg Message, args []string) (string, error)
+}
+
+// CommandRegistry holds the slash commands a CommandBot understands.
+type CommandRegistry struct {
+	mu       sync.Mutex
+	commands map[string]Command
+}
+
+// NewCommandRegistry creates a registry containing the given commands
+func NewCommandRegistry(commands ...Command) *CommandRegistry {
+	reg := &CommandRegistry{commands: make(map[string]Command)}
+	for _, cmd := range commands {
+		reg.Register(cmd)
+	}
+	return reg
+}
+
+// Register adds a command, replacing any command with the same name
+func (reg *CommandRegistry) Register(cmd Command) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.commands[strings.ToLower(cmd.Name)] = cmd
+}
+
+// Lookup finds a command by name, ignoring case
+func (reg *CommandRegistry) Lookup(name string) (Command, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	cmd, ok := reg.commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// List returns all commands sorted by name
+func (reg *CommandRegistry) List() []Command {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	list := make([]Command, 0, len(reg.commands))
+	for _, cmd := range reg.commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ParseCommand splits a message like `/remind 10m "stand up"` into the command
+// name and its arguments. Double quotes group words into one argument.
+// ok is false if the message is not a slash command.
+func ParseCommand(text string) (name string, args []string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") || len(text) < 2 {
+		return "", nil, false
+	}
+
+	var fields []string
+	var current strings.Builder
+	inQuotes, inField := false, false
+	for _, r := range text[1:] {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	if len(fields) == 0 || fields[0] == "" {
+		return "", nil, false
+	}
+	return fields[0], fields[1:], true
+}
+
+// CommandBot is a Bot that answers slash commands from its registry.
+type CommandBot struct {
+	Commands *CommandRegistry
+}
+
+// HandleMessage implements Bot
+func (b *CommandBot) HandleMessage(ctx *BotContext, msg Message) {
+	if msg.IsEncrypted() {
+		return
+	}
+
+	reply := ""
+	name, args, ok := ParseCommand(msg.Message)
+	if cmd, found := b.Commands.Lookup(name); !ok {
+		reply = "I only understand slash commands, try /help"
+	} else if !found {
+		reply = "Unknown command /" + name + ", try /help"
+	} else {
+		var err error
+		if reply, err = cmd.Handler(ctx, msg, args); err != nil {
+			reply = "/" + cmd.Name + " failed: " + err.Error()
+		}
+	}
+
+	if reply == "" {
+		return
+	}
+	if err := ctx.Reply(msg.SenderID, reply); err != nil {
+		fmt.Println("Bot reply failed:", err)
+	}
+}
+
+// DefaultCommands returns the built-in slash commands
+func DefaultCommands() *CommandRegistry {
+	reg := NewCommandRegistry(
+		Command{Name: "whois", Usage: "<name>", Help: "Show the ID of a user", Handler: whoisCommand},
+		Command{Name: "remind", Usage: "<duration> <text>", Help: "Send yourself a reminder, e.g. /remind 10m \"stand up\"", Handler: remindCommand},
+	)
+	reg.Register(Command{Name: "help", Help: "List all commands", Handler: func(ctx *BotContext, msg Message, args []string) (string, error) {
+		var b strings.Builder
+		b.WriteString("Available commands:")
+		for _, cmd := range reg.List() {
+			fmt.Fprintf(&b, "\n/%s %s - %s", cmd.Name, cmd.Usage, cmd.Help)
+		}
+		return b.String(), nil
+	}})
+	return reg
+}
+
+// whoisCommand looks up a user by name
+func whoisCommand(ctx *BotContext, msg Message, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: /whois <name>")
+	}
+
+	id, found := ctx.CS.UserIDByName(args[0])
+	if !found {
+		return "No user called " + args[0], nil
+	}
+	return args[0] + " has the user ID " + id, nil
+}
+
+// remindCommand schedules a message from the bot back to the sender
+func remindCommand(ctx *BotContext, msg Message, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("usage: /remind <duration> <text>")
+	}
+	delay, err := time.ParseDuration(args[0])
+	if err != nil || delay <= 0 {
+		return "", errors.New("invalid duration " + args[0] + ", use something like 10m or 2h")
+	}
+	if ctx.CS.scheduler == nil {
+		return "", errors.New("scheduling is not available")
+	}
+
+	reminder := CreateMessage(ctx.BotID, msg.SenderID, "Reminder: "+strings.Join(args[1:], " "))
+	if _, err := ctx.CS.scheduler.Schedule(reminder, time.Now().Add(delay)); err != nil {
+		return "", err
+	}
+	return "OK, I will remind you in " + delay.String(), nil
+}
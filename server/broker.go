@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of message events
+const (
+	EventMessage = ""     // A message was delivered
+	EventPoll    = "poll" // The results of a poll changed
+)
+
+// MessageEvent is published every time a message is delivered or the results
+// of a poll change.
+type MessageEvent struct {
+	Origin  string       // ID of the server instance that delivered the message
+	Kind    string       `json:",omitempty"` // One of the Event* kinds
+	Message Message      // The delivered message, for poll events only sender and receiver are set
+	Poll    *PollResults `json:",omitempty"` // The new results of a poll event
+}
+
+// Broker passes message events between server instances, so that realtime
+// subscribers on any instance see every message.
+type Broker interface {
+	Publish(event MessageEvent) error
+	// Subscribe returns a channel receiving all events and a function that ends
+	// the subscription and closes the channel.
+	Subscribe() (<-chan MessageEvent, func())
+}
+
+// subscriberBuffer is how many events a slow subscriber may fall behind before
+// events get dropped for it
+const subscriberBuffer = 64
+
+// instanceID identifies this server instance in published events
+var instanceID = NewID()
+
+// MemoryBroker is a Broker for a single instance. It also serves as the local
+// fan-out for the database backed broker.
+type MemoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan MessageEvent]struct{}
+}
+
+// NewMemoryBroker creates a MemoryBroker without subscribers
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: make(map[chan MessageEvent]struct{})}
+}
+
+// Publish implements Broker. It never blocks: subscribers that are too far
+// behind miss the event.
+func (b *MemoryBroker) Publish(event MessageEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			fmt.Println("Dropped message event for a slow subscriber")
+		}
+	}
+	return nil
+}
+
+// Subscribe implements Broker
+func (b *MemoryBroker) Subscribe() (<-chan MessageEvent, func()) {
+	ch := make(chan MessageEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// HTTP Handlers
+
+// StreamMessagesHandler streams every message sent or received by a user as
+// server-sent events, whichever instance delivered it. Changed results of the
+// user's polls are streamed as "poll" events. Only the user and admins may subscribe.
+func (cs *ChatService) StreamMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if !cs.requireParticipant(w, r, userID) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Streaming not supported"))
+		return
+	}
+
+	events, cancel := cs.broker.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			msg := event.Message
+			if msg.SenderID != userID && msg.ReceiverID != userID {
+				continue
+			}
+			if event.Kind == EventPoll {
+				data, err := json.Marshal(event.Poll)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: poll\ndata: %s\n\n", data)
+				flusher.Flush()
+				continue
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", msg.ID, data)
+			flusher.Flush()
+		}
+	}
+}
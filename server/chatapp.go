@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -10,103 +11,435 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// ChatService handles user management and message sending
+// ChatService handles user management and message sending.
+// Messages are indexed so lookups don't have to scan everything.
 type ChatService struct {
-	users    map[string]ChatUser // Map of user IDs to users
-	messages []Message           // Slice to store messages
-	mu       sync.Mutex          // Mutex to handle concurrent access
+	users     UserRepository // Users shared with the REST API and the pages
+	messages  []Message      // Slice to store messages
+	scheduler *Scheduler     // Delivers messages sent with a send_at time
+	bots      map[string]Bot // Bots by their user ID
+	broker    Broker         // Publishes delivered messages to realtime subscribers
+	mu        sync.RWMutex   // Guards messages, bots and the indexes below
+
+	byID           map[string]int   // Message ID -> position in messages
+	inbox          map[string][]int // Receiver ID -> positions of their messages
+	sent           map[string][]int // Sender ID -> positions of their messages
+	byConversation map[string][]int // Conversation ID -> positions of its messages
+	replies        map[string][]int // Message ID -> positions of its direct replies
 }
 
 // NewChatService creates a new ChatService
 func NewChatService() *ChatService {
-	return &ChatService{
-		users:    make(map[string]ChatUser),
+	cs := &ChatService{
+		users:    userRepo,
 		messages: []Message{},
+		bots:     make(map[string]Bot),
+		broker:   NewMemoryBroker(),
 	}
+	cs.reindex()
+	return cs
 }
 
-// RegisterUser registers a new user in the chat application
-func (cs *ChatService) RegisterUser(id, name, password string) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+// RegisterUser registers a new user in the chat application.
+// Names are unique, ignoring case; registering an existing ID replaces that user.
+func (cs *ChatService) RegisterUser(id, name, password string) error {
+	return cs.registerUser(id, name, password, "user")
+}
 
-	cs.users[id] = ChatUser{
+// registerUser creates or replaces a user with the given role. The password is
+// stored as a bcrypt hash; without one the user can't log in.
+func (cs *ChatService) registerUser(id, name, password, role string) error {
+	user := ChatUser{
 		InternData: User{
-			ID:   id,
-			Name: name,
+			ID:        id,
+			Name:      name,
+			CreatedAt: time.Now(),
+			Version:   1,
 		},
+		Role: role,
+	}
+	if password != "" {
+		hash, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
+		user.HashPassword = hash
+	}
 
-		Password: password,
+	err := cs.users.Create(user)
+	if errors.Is(err, ErrUserExists) {
+		old, getErr := cs.users.Get(id)
+		if getErr != nil {
+			return getErr
+		}
+		user.InternData.CreatedAt = old.InternData.CreatedAt
+		user.InternData.Version = old.InternData.Version + 1
+		err = cs.users.Update(user, old.InternData.Version)
+	}
+	if errors.Is(err, ErrNameTaken) {
+		return errors.New("Name " + name + " is already taken")
 	}
+	if err != nil {
+		return err
+	}
+
 	fmt.Print("Successfully Registered " + name + " \n")
+	return nil
+}
+
+// SetRole changes the role of a user. Returns false if the user does not exist.
+func (cs *ChatService) SetRole(id, role string) bool {
+	for {
+		user, err := cs.users.Get(id)
+		if err != nil {
+			return false
+		}
+		version := user.InternData.Version
+		user.Role = role
+		user.InternData.Version++
+		// Retry if someone else changed the user in between
+		if err := cs.users.Update(user, version); !errors.Is(err, ErrVersionConflict) {
+			return err == nil
+		}
+	}
+}
+
+// UserIDByName looks up the ID of a user by name, ignoring case
+func (cs *ChatService) UserIDByName(name string) (string, bool) {
+	user, err := cs.users.GetByName(name)
+	return user.InternData.ID, err == nil
+}
+
+// indexMessage adds the message at position pos to the message indexes.
+// The caller must hold cs.mu for writing.
+func (cs *ChatService) indexMessage(pos int) {
+	msg := cs.messages[pos]
+	cs.byID[msg.ID] = pos
+	cs.inbox[msg.ReceiverID] = append(cs.inbox[msg.ReceiverID], pos)
+	cs.sent[msg.SenderID] = append(cs.sent[msg.SenderID], pos)
+	conversation := ConversationID(msg.SenderID, msg.ReceiverID)
+	cs.byConversation[conversation] = append(cs.byConversation[conversation], pos)
+	if msg.ReplyTo != "" {
+		cs.replies[msg.ReplyTo] = append(cs.replies[msg.ReplyTo], pos)
+	}
+}
+
+// reindex rebuilds all message indexes, needed whenever messages are removed.
+// The caller must hold cs.mu for writing.
+func (cs *ChatService) reindex() {
+	cs.byID = make(map[string]int, len(cs.messages))
+	cs.inbox = make(map[string][]int)
+	cs.sent = make(map[string][]int)
+	cs.byConversation = make(map[string][]int)
+	cs.replies = make(map[string][]int)
+	for pos := range cs.messages {
+		cs.indexMessage(pos)
+	}
+}
+
+// messagesAt returns copies of the messages at the given positions.
+// The caller must hold cs.mu.
+func (cs *ChatService) messagesAt(positions []int) []Message {
+	msgs := make([]Message, 0, len(positions))
+	for _, pos := range positions {
+		msgs = append(msgs, cs.messages[pos])
+	}
+	return msgs
 }
 
 // SendMessage sends a message from one user to another
 func (cs *ChatService) SendMessage(senderID, receiverID, message string) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	if err := cs.Deliver(CreateMessage(senderID, receiverID, message)); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	if _, ok := cs.users[senderID]; !ok {
-		fmt.Println("Sender not found")
-		return
+// Deliver stores a fully built message, which may carry an encrypted payload.
+// Returns an error if the sender or receiver is not registered.
+func (cs *ChatService) Deliver(msg Message) error {
+	_, err := cs.deliver(msg)
+	return err
+}
+
+// deliver is Deliver returning the stored message with its ID and timestamp.
+// Users and mentions are looked up before and the message is published after
+// storing it, so cs.mu is only held while the message is added.
+func (cs *ChatService) deliver(msg Message) (Message, error) {
+	sender, err := cs.users.Get(msg.SenderID)
+	if err != nil {
+		return Message{}, errors.New("Sender not found")
 	}
-	if _, ok := cs.users[receiverID]; !ok {
-		fmt.Println("Receiver not found")
-		return
+	receiver, err := cs.users.Get(msg.ReceiverID)
+	if err != nil {
+		return Message{}, errors.New("Receiver not found")
 	}
-
-	msg := Message{
-		SenderID:   senderID,
-		ReceiverID: receiverID,
-		Message:    message,
-		TimeStamp:  time.Now(),
+	if err := suspensions.Check(msg.SenderID); err != nil {
+		return Message{}, err
 	}
+	mentioned := cs.mentionedUsers(msg)
 
+	cs.mu.Lock()
+	if err := cs.validateReply(msg); err != nil {
+		cs.mu.Unlock()
+		return Message{}, err
+	}
+	msg.ID = NewID()
+	msg.ReplyCount = 0
+	msg.Previews = nil
+	msg.TimeStamp = time.Now()
+	firstInConversation := len(cs.byConversation[ConversationID(msg.SenderID, msg.ReceiverID)]) == 0
 	cs.messages = append(cs.messages, msg)
-	fmt.Printf("Message from %s to %s: %s\n", cs.users[senderID].InternData.Name, cs.users[receiverID].InternData.Name, message)
+	cs.indexMessage(len(cs.messages) - 1)
+	cs.mu.Unlock()
+
+	if msg.IsEncrypted() {
+		fmt.Printf("Encrypted message from %s to %s (%d bytes)\n", sender.InternData.Name, receiver.InternData.Name, len(msg.Ciphertext))
+	} else {
+		fmt.Printf("Message from %s to %s: %s\n", sender.InternData.Name, receiver.InternData.Name, msg.Message)
+	}
+	if err := cs.broker.Publish(MessageEvent{Origin: instanceID, Message: msg}); err != nil {
+		fmt.Println("Publishing message failed:", err)
+	}
+	notifyForMessage(msg, sender.InternData.Name, mentioned, firstInConversation)
+	cs.dispatchToBot(msg)
+	linkPreviews.Prefetch(msg)
+	return msg, nil
 }
 
-// GetMessagesForUser retrieves all messages sent to a specific user
-func (cs *ChatService) GetMessagesForUser(userID string) []Message {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+// SendModerated runs msg through the moderation pipeline and delivers it. It is
+// meant for senders without an HTTP request to answer, like the scheduler and
+// bots. Flagged messages are held for review, rejected ones return an error.
+func (cs *ChatService) SendModerated(msg Message) error {
+	_, err := cs.sendModerated(msg)
+	return err
+}
+
+// sendModerated is SendModerated returning the delivered message, or nil if the
+// message is held for review
+func (cs *ChatService) sendModerated(msg Message) (*Message, error) {
+	msg, res := moderation.Screen(msg, cs.Deliver)
 
-	var userMessages []Message
-	for _, msg := range cs.messages {
-		if msg.ReceiverID == userID {
-			userMessages = append(userMessages, msg)
+	switch res.Action {
+	case FilterReject:
+		return nil, errors.New("Message rejected: " + res.Reason)
+	case FilterFlag:
+		return nil, nil
+	}
+	stored, err := cs.deliver(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// SendChecked sends a plain text message right away, after the checks of checkSend
+// and moderation. SendMessageHandler and the GraphQL and gRPC APIs send through it,
+// so the same rules apply everywhere. Returns the delivered message, or nil if it
+// is held for review. Errors carry the status the HTTP API answers with.
+func (cs *ChatService) SendChecked(msg Message, role string) (*Message, *Problem) {
+	msg.PollID = "" // Polls are only sent through CreatePollHandler
+	if p := cs.checkSend(msg, role); p != nil {
+		return nil, p
+	}
+
+	stored, err := cs.sendModerated(msg)
+	if err != nil {
+		return nil, NewProblem(http.StatusUnprocessableEntity, err.Error())
+	}
+	return stored, nil
+}
+
+// checkSend runs the checks every message goes through before it is sent or
+// scheduled: validation, existing users, suspensions, rate limits for the
+// sender's role and replies. It returns nil if msg may be sent.
+func (cs *ChatService) checkSend(msg Message, role string) *Problem {
+	if errs := append(Validate(msg), messageSizeErrors(msg)...); errs != nil {
+		return ValidationProblem(errs)
+	}
+	for _, id := range []string{msg.SenderID, msg.ReceiverID} {
+		if _, err := cs.users.Get(id); err != nil {
+			return repoProblem(err)
 		}
 	}
-	return userMessages
+	if cs.IsBot(msg.SenderID) {
+		return NewProblem(http.StatusForbidden, "Messages can't be sent in the name of a bot")
+	}
+	if err := suspensions.Check(msg.SenderID); err != nil {
+		return NewProblem(http.StatusForbidden, err.Error())
+	}
+	if p := sendLimiter.CheckRole(msg.SenderID, msg.ReceiverID, role); p != nil {
+		return p
+	}
+	if err := cs.ValidateReply(msg); err != nil {
+		return NewProblem(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// senderFor returns the ID the caller of claims sends messages as: their own
+// user, or for admins the requested sender. requested may be empty, any other
+// sender than the caller is refused for everyone else.
+func (cs *ChatService) senderFor(claims *Claims, requested string) (string, *Problem) {
+	if claims == nil {
+		return "", NewProblem(http.StatusUnauthorized, "A valid JWT is required in the Authorization header")
+	}
+	if claims.Role == "admin" && requested != "" {
+		return requested, nil
+	}
+	callerID, found := cs.UserIDByName(claims.Username)
+	if !found {
+		return "", NewProblem(http.StatusNotFound, "User not found")
+	}
+	if requested != "" && requested != callerID {
+		return "", NewProblem(http.StatusForbidden, "Messages can only be sent in your own name")
+	}
+	return callerID, nil
+}
+
+// GetMessagesForUser retrieves all messages sent to a specific user
+func (cs *ChatService) GetMessagesForUser(userID string) []Message {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.messagesAt(cs.inbox[userID])
 }
 
 // HTTP Handlers
 
+// maxSendBodyBytes limits the body of a send request, which has room for the
+// largest ciphertext and its envelopes encoded in base64.
+const maxSendBodyBytes = 2 * maxCiphertextBytes
+
+// SendMessageHandler sends a message as the caller, or schedules it with send_at.
+// Only admins may give another SenderID.
 func (cs *ChatService) SendMessageHandler(w http.ResponseWriter, r *http.Request) {
-	var msg Message
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	claims, _ := ClaimsFromRequest(r)
+	if claims == nil {
+		WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "A valid JWT is required in the Authorization header"))
+		return
+	}
+
+	var req struct {
+		Message
+		SendAt *time.Time `json:"send_at"` // Optional time to send the message at
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSendBodyBytes)).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	msg := req.Message
+	senderID, p := cs.senderFor(claims, msg.SenderID)
+	if p != nil {
+		WriteProblem(w, r, p)
+		return
+	}
+	msg.SenderID = senderID
+	role := claims.Role
+
+	// Plain text messages sent right away take the path of the GraphQL and gRPC APIs
+	if !msg.IsEncrypted() && (req.SendAt == nil || !req.SendAt.After(time.Now())) {
+		stored, p := cs.SendChecked(msg, role)
+		if p != nil {
+			WriteProblem(w, r, p)
+			return
+		}
+		if stored == nil {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, "Message held for review")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	// Encrypted and scheduled messages get the same checks, but no moderation yet:
+	// the server can't read encrypted messages, and scheduled ones are moderated
+	// when they are sent
+	msg.PollID = "" // Polls are only sent through CreatePollHandler
+	if p := cs.checkSend(msg, role); p != nil {
+		WriteProblem(w, r, p)
+		return
+	}
+	if msg.IsEncrypted() {
+		if err := keyDirectory.ValidateEnvelopes(msg); err != nil {
+			WriteProblem(w, r, NewProblem(http.StatusBadRequest, err.Error()))
+			return
+		}
+	}
+
+	if req.SendAt == nil || !req.SendAt.After(time.Now()) {
+		if err := cs.Deliver(msg); err != nil {
+			WriteProblem(w, r, NewProblem(http.StatusNotFound, err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
 		return
 	}
 
-	cs.SendMessage(msg.SenderID, msg.ReceiverID, msg.Message)
-	w.WriteHeader(http.StatusCreated)
+	sm, err := cs.scheduler.Schedule(msg, *req.SendAt)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error scheduling message"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(sm)
 }
 
+// GetMessagesHandler returns the inbox of a user. Only the user and admins may read it.
 func (cs *ChatService) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID := params["id"]
+	if !cs.requireParticipant(w, r, userID) {
+		return
+	}
 
-	messages := cs.GetMessagesForUser(userID)
+	messages := linkPreviews.Attach(cs.withReplyCounts(cs.GetMessagesForUser(userID)))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
 
-func ChatAppMain(r mux.Router, port string) {
+// ChatAppMain sets up the chat service with its stores, registers its routes on api
+// and starts its background work: the scheduler, the retention sweeper and the gRPC
+// server on grpcPort.
+func ChatAppMain(api *API, port, grpcPort string) {
+	// Users are shared with the REST API and the pages, keep them in the database if there is one
+	if db != nil {
+		userRepo = SQLUserRepository{DB: db}
+		// Suspensions and the audit trail apply to all instances, like the users
+		suspensions.Store = SQLSuspensionStore{DB: db}
+		auditLog = SQLAuditLog{DB: db}
+	}
 	chatService := NewChatService()
-	// Register routes for the chat functionality
-	r.HandleFunc("/messages", chatService.SendMessageHandler).Methods("POST")
-	r.HandleFunc("/messages/{id}", chatService.GetMessagesHandler).Methods("GET")
+
+	var scheduleStore ScheduleStore = NewMemoryScheduleStore()
+	if db != nil {
+		scheduleStore = SQLScheduleStore{DB: db}
+	}
+	chatService.scheduler = NewScheduler(chatService, scheduleStore)
+	chatService.scheduler.Start(time.Second, nil)
+
+	// Share messages with the other instances when running on the database
+	if db != nil {
+		broker, err := NewSQLBroker(db, instanceID, time.Second)
+		if err != nil {
+			fmt.Println("Falling back to in-memory broker:", err)
+		} else {
+			chatService.broker = broker
+		}
+	}
+
+	RegisterChatRoutes(api, chatService)
+	chatService.StartRetentionSweeper(retention, time.Minute, nil)
+
+	// gRPC API with the user and chat services, on its own port
+	go func() {
+		if err := ServeGRPC(chatService, ":"+grpcPort); err != nil {
+			fmt.Println("gRPC server stopped:", err)
+		}
+	}()
+
+	// Built-in bot answering slash commands
+	chatService.RegisterBot("bot", "assistant", &CommandBot{Commands: DefaultCommands()})
 
 	// Example: Register some users
 	chatService.RegisterUser("1", "Jakub", "password123")
@@ -116,3 +449,74 @@ func ChatAppMain(r mux.Router, port string) {
 
 	//log.Fatal(http.ListenAndServe(":"+port, r))
 }
+
+// RegisterChatRoutes registers the JSON endpoints of the chat served by cs and the
+// target of the message form. Every route has to be listed in openapi.go as well.
+func RegisterChatRoutes(api *API, cs *ChatService) {
+	// Messages, threads and conversations
+	api.HandleFunc("POST", "/messages", cs.SendMessageHandler)
+	api.HandleFunc("GET", "/messages/{id}", cs.GetMessagesHandler)
+	api.HandleFunc("GET", "/messages/{id}/stream", cs.StreamMessagesHandler)
+	api.HandleFunc("GET", "/threads/{id}", cs.GetThreadHandler)
+	api.HandleFunc("GET", "/conversations/{id}/messages", cs.GetConversationHandler)
+	api.HandleUnversioned("POST", "/restful/send", http.HandlerFunc(cs.SendMessageFormHandler))
+
+	// Polls inside conversations
+	api.HandleFunc("POST", "/polls", cs.CreatePollHandler)
+	api.HandleFunc("GET", "/polls/{id}", cs.GetPollHandler)
+	api.HandleFunc("POST", "/polls/{id}/votes", cs.VotePollHandler)
+	api.HandleFunc("POST", "/polls/{id}/close", cs.ClosePollHandler)
+
+	// Scheduled messages of the calling user
+	api.HandleFunc("GET", "/scheduled", cs.scheduler.ListScheduledHandler)
+	api.HandleFunc("PUT", "/scheduled/{id}", cs.scheduler.EditScheduledHandler)
+	api.HandleFunc("DELETE", "/scheduled/{id}", cs.scheduler.CancelScheduledHandler)
+
+	// Notification center of the calling user
+	api.HandleFunc("GET", "/notifications", cs.GetNotificationsHandler)
+	api.HandleFunc("POST", "/notifications/read", cs.MarkAllNotificationsReadHandler)
+	api.HandleFunc("GET", "/notifications/preferences", cs.GetNotificationPrefsHandler)
+	api.HandleFunc("PUT", "/notifications/preferences", cs.SetNotificationPrefsHandler)
+	api.HandleFunc("POST", "/notifications/{id}/read", cs.MarkNotificationReadHandler)
+
+	// Public key directory for end-to-end encrypted messages
+	api.HandleFunc("GET", "/keys/{id}", GetKeysHandler)
+	api.HandleFunc("PUT", "/keys/{id}/{device}", cs.PublishKeyHandler)
+	api.HandleFunc("DELETE", "/keys/{id}/{device}", cs.RevokeKeyHandler)
+
+	// Review queue for messages flagged by the moderation pipeline (admin only)
+	api.Handle("GET", "/admin/review", IsAdmin(http.HandlerFunc(ReviewQueueHandler)))
+	api.Handle("POST", "/admin/review/{id}", IsAdmin(http.HandlerFunc(ResolveReviewHandler)))
+
+	// Admin moderation tools, every action ends up in the audit trail
+	api.Handle("GET", "/admin/messages", IsAdmin(http.HandlerFunc(cs.AdminListMessagesHandler)))
+	api.Handle("DELETE", "/admin/messages/{id}", IsAdmin(http.HandlerFunc(cs.AdminDeleteMessageHandler)))
+	api.Handle("PUT", "/admin/users/{id}/suspension", IsAdmin(http.HandlerFunc(SuspendUserHandler)))
+	api.Handle("DELETE", "/admin/users/{id}/suspension", IsAdmin(http.HandlerFunc(LiftSuspensionHandler)))
+	api.Handle("GET", "/admin/users/{id}/activity", IsAdmin(http.HandlerFunc(cs.UserActivityHandler)))
+	api.Handle("PUT", "/admin/users/{id}/role", IsAdmin(http.HandlerFunc(cs.SetRoleHandler)))
+	api.Handle("GET", "/admin/audit", IsAdmin(http.HandlerFunc(GetAuditLogHandler)))
+
+	// Message retention, disappearing messages and legal holds
+	api.HandleFunc("PUT", "/conversations/{id}/timer", cs.SetTimerHandler)
+	api.Handle("PUT", "/admin/retention", IsAdmin(http.HandlerFunc(SetRetentionHandler)))
+	api.Handle("GET", "/admin/holds", IsAdmin(http.HandlerFunc(GetHoldsHandler)))
+	api.Handle("PUT", "/admin/holds/{id}", IsAdmin(http.HandlerFunc(PlaceHoldHandler)))
+	api.Handle("DELETE", "/admin/holds/{id}", IsAdmin(http.HandlerFunc(ReleaseHoldHandler)))
+
+	// Announcements to all users or the users of some roles
+	api.Handle("POST", "/admin/announcements", IsAdmin(http.HandlerFunc(cs.PublishAnnouncementHandler)))
+	api.Handle("GET", "/admin/announcements", IsAdmin(http.HandlerFunc(ListAnnouncementsHandler)))
+	api.Handle("DELETE", "/admin/announcements/{id}", IsAdmin(http.HandlerFunc(WithdrawAnnouncementHandler)))
+	api.HandleFunc("GET", "/announcements", ActiveAnnouncementsHandler)
+	api.HandleFunc("POST", "/announcements/{id}/dismiss", DismissAnnouncementHandler)
+
+	// Data export in json, csv or mbox format
+	api.HandleFunc("GET", "/me/export", cs.ExportHandler)
+	api.Handle("GET", "/admin/users/{id}/export", IsAdmin(http.HandlerFunc(cs.AdminExportHandler)))
+
+	// GraphQL over users, conversations and messages
+	api.HandleUnversioned("GET", "/graphql", http.HandlerFunc(cs.GraphQLHandler))
+	api.HandleUnversioned("POST", "/graphql", http.HandlerFunc(cs.GraphQLHandler))
+	api.HandleUnversioned("GET", "/graphql/schema", http.HandlerFunc(GraphQLSchemaHandler))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchSizes are the numbers of users and messages the benchmarks run with.
+// Lookups go through the indexes, so ns/op should stay about the same for all of them.
+var benchSizes = []int{1e3, 1e5, 1e6}
+
+// benchInboxSize is the number of messages in the inbox that BenchmarkInbox reads
+const benchInboxSize = 100
+
+// newBenchChatService creates a ChatService with n users named user0 to user<n-1>.
+// The users are created without passwords, hashing a million of them would take hours.
+func newBenchChatService(b *testing.B, n int) *ChatService {
+	b.Helper()
+	userRepo = NewMemoryUserRepository()
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		err := userRepo.Create(ChatUser{InternData: User{ID: id, Name: "user" + id, CreatedAt: time.Now(), Version: 1}, Role: "user"})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return NewChatService()
+}
+
+// BenchmarkLogin measures the user lookup of a login, by name and ignoring case
+func BenchmarkLogin(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) {
+			cs := newBenchChatService(b, n)
+			name := fmt.Sprintf("USER%d", n/2)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found := cs.UserIDByName(name); !found {
+					b.Fatal(name, "not found")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkInbox measures reading an inbox of benchInboxSize messages while the
+// total number of messages grows
+func BenchmarkInbox(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("messages=%d", n), func(b *testing.B) {
+			cs := newBenchChatService(b, 1000)
+
+			// Every message but the first benchInboxSize goes to someone else than user 0
+			cs.messages = make([]Message, n)
+			for i := range cs.messages {
+				receiver := strconv.Itoa(1 + i%999)
+				if i < benchInboxSize {
+					receiver = "0"
+				}
+				cs.messages[i] = Message{ID: NewID(), SenderID: strconv.Itoa(i % 1000), ReceiverID: receiver, Message: "hello", TimeStamp: time.Now()}
+			}
+			cs.reindex()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if inbox := cs.GetMessagesForUser("0"); len(inbox) != benchInboxSize {
+					b.Fatal("inbox has", len(inbox), "messages")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UserETag returns the entity tag of a user representation. It changes with every update.
+// The creation time tells apart a user that was deleted and created again under the
+// same ID, whose version starts over.
+func UserETag(user User) string {
+	return `"` + user.ID + "." + strconv.FormatInt(user.CreatedAt.UnixNano(), 36) + "." + strconv.Itoa(user.Version) + `"`
+}
+
+// contentETag returns an entity tag derived from a response body and the header
+// values that describe it, like the total count of a page
+func contentETag(body []byte, headers ...string) string {
+	h := sha256.New()
+	h.Write(body)
+	for _, header := range headers {
+		h.Write([]byte{0})
+		h.Write([]byte(header))
+	}
+	sum := h.Sum(nil)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match header value
+// contains etag. Weak tags match their strong counterpart when weak is true.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers a GET with 304 Not Modified if its If-None-Match header
+// matches etag, and returns true if it did. Otherwise it sets the ETag header.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagListMatches(header, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// checkIfMatch enforces optimistic concurrency on a write: the request must send
+// an If-Match header (428 otherwise) matching the current etag (412 otherwise).
+// Returns false if it answered the request.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		WriteProblem(w, r, NewProblem(http.StatusPreconditionRequired, "If-Match header required, fetch the resource for its ETag first"))
+		return false
+	}
+	if !etagListMatches(header, etag, false) {
+		w.Header().Set("ETag", etag)
+		WriteProblem(w, r, NewProblem(http.StatusPreconditionFailed, "The resource was changed by someone else, fetch it again"))
+		return false
+	}
+	return true
+}
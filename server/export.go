@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportChunk is how many chat messages are copied per lock while exporting
+const exportChunk = 256
+
+// MessageWriter writes messages of an export one at a time, so an export never
+// has to hold all messages in memory.
+type MessageWriter interface {
+	Write(msg Message) error
+	Close() error // Writes whatever trailer the format needs
+}
+
+// NewMessageWriter returns a writer for the given export format (json, csv or mbox)
+func NewMessageWriter(format string, w io.Writer) (MessageWriter, bool) {
+	switch format {
+	case "json":
+		return &jsonMessageWriter{w: w}, true
+	case "csv":
+		return &csvMessageWriter{w: csv.NewWriter(w)}, true
+	case "mbox":
+		return &mboxMessageWriter{w: w}, true
+	}
+	return nil, false
+}
+
+// jsonMessageWriter writes a JSON array of messages
+type jsonMessageWriter struct {
+	w       io.Writer
+	started bool
+}
+
+// Write implements MessageWriter
+func (j *jsonMessageWriter) Write(msg Message) error {
+	sep := ","
+	if !j.started {
+		sep = "["
+		j.started = true
+	}
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+// Close implements MessageWriter
+func (j *jsonMessageWriter) Close() error {
+	if !j.started {
+		_, err := io.WriteString(j.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+// csvMessageWriter writes one CSV row per message
+type csvMessageWriter struct {
+	w       *csv.Writer
+	started bool
+}
+
+// writeHeader writes the header row before the first message
+func (c *csvMessageWriter) writeHeader() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	return c.w.Write([]string{"timestamp", "sender_id", "receiver_id", "message", "ciphertext", "key_envelopes"})
+}
+
+// Write implements MessageWriter
+func (c *csvMessageWriter) Write(msg Message) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	ciphertext := ""
+	if msg.IsEncrypted() {
+		ciphertext = base64.StdEncoding.EncodeToString(msg.Ciphertext)
+	}
+	return c.w.Write([]string{
+		msg.TimeStamp.Format(time.RFC3339),
+		msg.SenderID,
+		msg.ReceiverID,
+		msg.Message,
+		ciphertext,
+		strconv.Itoa(len(msg.Envelopes)),
+	})
+}
+
+// Close implements MessageWriter
+func (c *csvMessageWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// mboxMessageWriter writes messages as mails in mbox format
+type mboxMessageWriter struct {
+	w io.Writer
+}
+
+// Write implements MessageWriter
+func (m *mboxMessageWriter) Write(msg Message) error {
+	body := msg.Message
+	if msg.IsEncrypted() {
+		body = "[encrypted message]\n" + base64.StdEncoding.EncodeToString(msg.Ciphertext)
+	}
+	// Lines starting with "From " would start a new mail, so they get quoted
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			lines[i] = ">" + line
+		}
+	}
+
+	_, err := fmt.Fprintf(m.w, "From %s@chat %s\nFrom: %s@chat\nTo: %s@chat\nDate: %s\nSubject: Chat message\n\n%s\n\n",
+		msg.SenderID, msg.TimeStamp.UTC().Format(time.ANSIC),
+		msg.SenderID, msg.ReceiverID, msg.TimeStamp.Format(time.RFC1123Z),
+		strings.Join(lines, "\n"))
+	return err
+}
+
+// Close implements MessageWriter
+func (m *mboxMessageWriter) Close() error {
+	return nil
+}
+
+// EachMessageOf calls fn for every chat message sent or received by userID, in send order.
+// The IDs of the messages are collected first and the messages are copied out by ID in
+// small chunks, so the lock is never held while fn writes and messages purged or deleted
+// in between don't shift the export past others.
+func (cs *ChatService) EachMessageOf(userID string, fn func(Message) error) error {
+	cs.mu.RLock()
+	positions := append(append([]int(nil), cs.sent[userID]...), cs.inbox[userID]...)
+	sort.Ints(positions)
+	ids := make([]string, 0, len(positions))
+	for i, pos := range positions {
+		if i > 0 && pos == positions[i-1] {
+			continue // Messages to oneself are in both lists
+		}
+		ids = append(ids, cs.messages[pos].ID)
+	}
+	cs.mu.RUnlock()
+
+	for start := 0; start < len(ids); start += exportChunk {
+		end := min(start+exportChunk, len(ids))
+		chunk := make([]Message, 0, end-start)
+		cs.mu.RLock()
+		for _, id := range ids[start:end] {
+			if pos, ok := cs.byID[id]; ok && !cs.messages[pos].Deleted {
+				chunk = append(chunk, cs.messages[pos])
+			}
+		}
+		cs.mu.RUnlock()
+
+		for _, msg := range chunk {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachStoredMessageOf calls fn for every row of the messages table sent or
+// received by userID, streaming the rows straight from the database.
+func eachStoredMessageOf(userID string, fn func(Message) error) error {
+	if db == nil {
+		return nil
+	}
+
+	rows, err := db.Query("SELECT sender_id, receiver_id, message, timestamp FROM messages WHERE sender_id = ? OR receiver_id = ? ORDER BY timestamp", userID, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.SenderID, &msg.ReceiverID, &msg.Message, &msg.TimeStamp); err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// export streams all messages of userID in the requested format
+func (cs *ChatService) export(w http.ResponseWriter, r *http.Request, userID string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	contentTypes := map[string]string{"json": "application/json", "csv": "text/csv", "mbox": "application/mbox"}
+	mw, ok := NewMessageWriter(format, w)
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "format must be json, csv or mbox"))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "messages-" + userID + "." + format}))
+
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	write := func(msg Message) error {
+		if err := mw.Write(msg); err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%exportChunk == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// Headers are already sent at this point, so errors can only be logged
+	if err := cs.EachMessageOf(userID, write); err != nil {
+		fmt.Println("Export failed:", err)
+		return
+	}
+	if err := eachStoredMessageOf(userID, write); err != nil {
+		fmt.Println("Export failed:", err)
+		return
+	}
+	if err := mw.Close(); err != nil {
+		fmt.Println("Export failed:", err)
+	}
+}
+
+// HTTP Handlers
+
+// ExportHandler exports every message the calling user sent or received
+func (cs *ChatService) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	cs.export(w, r, userID)
+}
+
+// AdminExportHandler exports every message of any user (admin only)
+func (cs *ChatService) AdminExportHandler(w http.ResponseWriter, r *http.Request) {
+	audit(r, "export_messages", mux.Vars(r)["id"], r.URL.Query().Get("format"))
+	cs.export(w, r, mux.Vars(r)["id"])
+}
@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file holds a small GraphQL engine: a parser for query documents and an
+// executor running them against a schema of resolver functions. It supports
+// queries, mutations and subscriptions with variables, aliases, fragments and the
+// @skip and @include directives, and introspection (see graphql_introspection.go).
+// Fields selected twice under the same response key are merged, as the
+// specification demands, and rejected if they differ in name or arguments.
+// Response objects are JSON encoded from maps, so their fields come out sorted by
+// name rather than in selection order.
+
+// Limits protecting the server from expensive queries
+const (
+	gqlMaxDepth      = 8    // Deepest allowed nesting of selection sets
+	gqlMaxComplexity = 2000 // Highest allowed query cost, see gqlValidator.cost
+	gqlDefaultFirst  = 20   // Page size of paginated fields without a first argument
+	gqlMaxFirst      = 100  // Largest page size of paginated fields
+	gqlMaxQueryBytes = 16 << 10
+)
+
+// Lexer
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	pos   int
+}
+
+// gqlLex splits a GraphQL document into tokens. Commas and comments are ignored.
+func gqlLex(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{gqlPunct, "...", i})
+			i += 3
+		case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+			tokens = append(tokens, gqlToken{gqlPunct, string(c), i})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{gqlName, src[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			kind := gqlInt
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || strings.IndexByte(".eE+-", src[i]) >= 0) {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = gqlFloat
+				}
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], start})
+		case c == '"':
+			s, n, err := gqlLexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at position %d", err, i)
+			}
+			tokens = append(tokens, gqlToken{gqlString, s, i})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, gqlToken{gqlEOF, "", len(src)}), nil
+}
+
+// gqlLexString reads a quoted string, returning its value and length in src
+func gqlLexString(src string) (string, int, error) {
+	if strings.HasPrefix(src, `"""`) {
+		end := strings.Index(src[3:], `"""`)
+		if end < 0 {
+			return "", 0, errors.New("unterminated block string")
+		}
+		return strings.TrimSpace(src[3 : 3+end]), end + 6, nil
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch src[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\n', '\r':
+			return "", 0, errors.New("unterminated string")
+		case '\\':
+			i++
+			if i >= len(src) {
+				return "", 0, errors.New("unterminated string")
+			}
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'u':
+				if i+4 >= len(src) {
+					return "", 0, errors.New("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(src[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, errors.New("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				i += 4
+			default:
+				b.WriteByte(src[i])
+			}
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// Syntax tree
+
+// gqlDocument is a parsed GraphQL request document
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+// gqlOperation is a query, mutation or subscription
+type gqlOperation struct {
+	kind       string
+	name       string
+	vars       []gqlVarDef
+	selections []*gqlSelection
+}
+
+// gqlVarDef declares a variable of an operation
+type gqlVarDef struct {
+	name     string
+	typ      string
+	fallback *gqlValue
+}
+
+// gqlFragment is a named fragment
+type gqlFragment struct {
+	typeCond   string
+	selections []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread or an inline fragment
+type gqlSelection struct {
+	alias      string
+	name       string // Field name, empty for fragments
+	args       map[string]gqlValue
+	directives map[string]map[string]gqlValue
+	selections []*gqlSelection
+	spread     string // Name of a spread fragment
+	typeCond   string // Type condition of an inline fragment
+	inline     bool
+}
+
+// key is the name of the field in the response
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// Kinds of values
+const (
+	gqlValVar = iota
+	gqlValInt
+	gqlValFloat
+	gqlValString
+	gqlValBool
+	gqlValNull
+	gqlValEnum
+	gqlValList
+	gqlValObject
+)
+
+// gqlValue is a literal or variable in a document
+type gqlValue struct {
+	kind   int
+	raw    string
+	list   []gqlValue
+	object map[string]gqlValue
+}
+
+// resolve turns the value into its Go form, looking up variables in vars
+func (v gqlValue) resolve(vars map[string]interface{}) interface{} {
+	switch v.kind {
+	case gqlValVar:
+		return vars[v.raw]
+	case gqlValInt:
+		n, _ := strconv.Atoi(v.raw)
+		return n
+	case gqlValFloat:
+		f, _ := strconv.ParseFloat(v.raw, 64)
+		return f
+	case gqlValBool:
+		return v.raw == "true"
+	case gqlValNull:
+		return nil
+	case gqlValList:
+		list := make([]interface{}, len(v.list))
+		for i, item := range v.list {
+			list[i] = item.resolve(vars)
+		}
+		return list
+	case gqlValObject:
+		obj := make(map[string]interface{}, len(v.object))
+		for name, item := range v.object {
+			obj[name] = item.resolve(vars)
+		}
+		return obj
+	}
+	return v.raw
+}
+
+// Parser
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+}
+
+// gqlParse parses a request document
+func gqlParse(src string) (*gqlDocument, error) {
+	tokens, err := gqlLex(strings.TrimPrefix(src, "\ufeff"))
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+
+	for p.peek().kind != gqlEOF {
+		tok := p.peek()
+		switch {
+		case tok.value == "{":
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: sel})
+		case tok.kind == gqlName && (tok.value == "query" || tok.value == "mutation" || tok.value == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case tok.kind == gqlName && tok.value == "fragment":
+			p.pos++
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.keyword("on"); err != nil {
+				return nil, err
+			}
+			typeCond, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, fmt.Errorf("fragment %s is defined twice", name)
+			}
+			doc.fragments[name] = &gqlFragment{typeCond: typeCond, selections: sel}
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("the document contains no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) unexpected() error {
+	tok := p.peek()
+	if tok.kind == gqlEOF {
+		return errors.New("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected %q at position %d", tok.value, tok.pos)
+}
+
+// punct consumes the punctuator want
+func (p *gqlParser) punct(want string) error {
+	if tok := p.peek(); tok.kind != gqlPunct || tok.value != want {
+		return p.unexpected()
+	}
+	p.pos++
+	return nil
+}
+
+// skip consumes the punctuator want if it comes next
+func (p *gqlParser) skip(want string) bool {
+	if tok := p.peek(); tok.kind == gqlPunct && tok.value == want {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) keyword(want string) error {
+	if tok := p.peek(); tok.kind != gqlName || tok.value != want {
+		return p.unexpected()
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	p.pos++
+	return tok.value, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.peek().value}
+	p.pos++
+	if p.peek().kind == gqlName {
+		op.name, _ = p.name()
+	}
+
+	if p.skip("(") {
+		for !p.skip(")") {
+			if err := p.punct("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.punct(":"); err != nil {
+				return nil, err
+			}
+			typ, err := p.typeRef()
+			if err != nil {
+				return nil, err
+			}
+			def := gqlVarDef{name: name, typ: typ}
+			if p.skip("=") {
+				v, err := p.value(true)
+				if err != nil {
+					return nil, err
+				}
+				def.fallback = &v
+			}
+			op.vars = append(op.vars, def)
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sel
+	return op, nil
+}
+
+// typeRef reads a type like [ID!]! and returns it as written
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.skip("[") {
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.punct("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if p.skip("!") {
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.punct("{"); err != nil {
+		return nil, err
+	}
+	var list []*gqlSelection
+	for !p.skip("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sel)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("empty selection set")
+	}
+	return list, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{}
+	var err error
+
+	if p.skip("...") {
+		if tok := p.peek(); tok.kind == gqlName && tok.value != "on" {
+			sel.spread, _ = p.name()
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		sel.inline = true
+		if tok := p.peek(); tok.kind == gqlName && tok.value == "on" {
+			p.pos++
+			if sel.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.skip(":") {
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if sel.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind == gqlPunct && tok.value == "{" {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments() (map[string]gqlValue, error) {
+	if !p.skip("(") {
+		return nil, nil
+	}
+	args := make(map[string]gqlValue)
+	for !p.skip(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.punct(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() (map[string]map[string]gqlValue, error) {
+	var dirs map[string]map[string]gqlValue
+	for p.skip("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		if dirs == nil {
+			dirs = make(map[string]map[string]gqlValue)
+		}
+		dirs[name] = args
+	}
+	return dirs, nil
+}
+
+// value reads a value, constant values may not contain variables
+func (p *gqlParser) value(constant bool) (gqlValue, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case gqlInt:
+		p.pos++
+		return gqlValue{kind: gqlValInt, raw: tok.value}, nil
+	case gqlFloat:
+		p.pos++
+		return gqlValue{kind: gqlValFloat, raw: tok.value}, nil
+	case gqlString:
+		p.pos++
+		return gqlValue{kind: gqlValString, raw: tok.value}, nil
+	case gqlName:
+		p.pos++
+		switch tok.value {
+		case "true", "false":
+			return gqlValue{kind: gqlValBool, raw: tok.value}, nil
+		case "null":
+			return gqlValue{kind: gqlValNull}, nil
+		}
+		return gqlValue{kind: gqlValEnum, raw: tok.value}, nil
+	}
+
+	switch {
+	case !constant && p.skip("$"):
+		name, err := p.name()
+		return gqlValue{kind: gqlValVar, raw: name}, err
+	case p.skip("["):
+		v := gqlValue{kind: gqlValList}
+		for !p.skip("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return v, err
+			}
+			v.list = append(v.list, item)
+		}
+		return v, nil
+	case p.skip("{"):
+		v := gqlValue{kind: gqlValObject, object: make(map[string]gqlValue)}
+		for !p.skip("}") {
+			name, err := p.name()
+			if err != nil {
+				return v, err
+			}
+			if err := p.punct(":"); err != nil {
+				return v, err
+			}
+			if v.object[name], err = p.value(constant); err != nil {
+				return v, err
+			}
+		}
+		return v, nil
+	}
+	return gqlValue{}, p.unexpected()
+}
+
+// Schema
+
+// gqlObject is an object type of a schema
+type gqlObject struct {
+	Name        string
+	Description string
+	Fields      map[string]*gqlField
+}
+
+// gqlField is a field of an object type
+type gqlField struct {
+	Type        string            // GraphQL type of the result, like [Message!]!
+	Args        map[string]string // Argument name -> GraphQL type
+	Description string
+	Object      *gqlObject // Type of the result if it is an object or a list of objects
+	Paginated   bool       // The field returns a page of at most first items, see gqlValidator.cost
+
+	Resolve func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error)
+
+	// Subscribe starts a subscription on a root subscription field. Every value sent
+	// on the channel is resolved against Object; stop ends the subscription.
+	Subscribe func(ctx *gqlContext, args map[string]interface{}) (events <-chan interface{}, stop func(), err error)
+}
+
+// gqlSchema is a GraphQL schema of resolver functions. Create it with newGQLSchema.
+type gqlSchema struct {
+	Query        *gqlObject
+	Mutation     *gqlObject
+	Subscription *gqlObject
+
+	types map[string]*gqlType // Named types by name, for introspection
+}
+
+// newGQLSchema creates a schema with the given root types. Mutation and
+// subscription may be nil. The query type gets the __schema and __type fields.
+func newGQLSchema(query, mutation, subscription *gqlObject) *gqlSchema {
+	s := &gqlSchema{Query: query, Mutation: mutation, Subscription: subscription}
+	s.addIntrospection()
+	return s
+}
+
+// root returns the root object of an operation kind
+func (s *gqlSchema) root(kind string) *gqlObject {
+	switch kind {
+	case "mutation":
+		return s.Mutation
+	case "subscription":
+		return s.Subscription
+	}
+	return s.Query
+}
+
+// objects returns every object type reachable from the root types by name
+func (s *gqlSchema) objects() map[string]*gqlObject {
+	objects := make(map[string]*gqlObject)
+	var collect func(o *gqlObject)
+	collect = func(o *gqlObject) {
+		if o == nil || objects[o.Name] != nil {
+			return
+		}
+		objects[o.Name] = o
+		for _, f := range o.Fields {
+			collect(f.Object)
+		}
+	}
+	collect(s.Query)
+	collect(s.Mutation)
+	collect(s.Subscription)
+	return objects
+}
+
+// SDL describes the schema in the GraphQL schema definition language.
+// The introspection types and fields are built in and left out.
+func (s *gqlSchema) SDL() string {
+	objects := s.objects()
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("schema {\n  query: " + s.Query.Name + "\n")
+	if s.Mutation != nil {
+		b.WriteString("  mutation: " + s.Mutation.Name + "\n")
+	}
+	if s.Subscription != nil {
+		b.WriteString("  subscription: " + s.Subscription.Name + "\n")
+	}
+	b.WriteString("}\n")
+
+	for _, name := range names {
+		o := objects[name]
+		b.WriteString("\n")
+		if o.Description != "" {
+			b.WriteString(`"""` + o.Description + `"""` + "\n")
+		}
+		b.WriteString("type " + o.Name + " {\n")
+		fields := make([]string, 0, len(o.Fields))
+		for fieldName := range o.Fields {
+			if !strings.HasPrefix(fieldName, "__") {
+				fields = append(fields, fieldName)
+			}
+		}
+		sort.Strings(fields)
+		for _, fieldName := range fields {
+			f := o.Fields[fieldName]
+			if f.Description != "" {
+				b.WriteString(`  "` + f.Description + `"` + "\n")
+			}
+			b.WriteString("  " + fieldName)
+			if len(f.Args) > 0 {
+				args := make([]string, 0, len(f.Args))
+				for arg, typ := range f.Args {
+					args = append(args, arg+": "+typ)
+				}
+				sort.Strings(args)
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.Type + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// Execution
+
+// gqlError is an error in a GraphQL response
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlResponse is the result of a GraphQL operation
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// gqlContext is passed to every resolver of a request
+type gqlContext struct {
+	cs     *ChatService
+	claims *Claims // Nil if the request carried no valid JWT
+	vars   map[string]interface{}
+	doc    *gqlDocument
+	errors []gqlError
+}
+
+// gqlRequest is a prepared operation, checked against the schema and the limits
+type gqlRequest struct {
+	ctx  *gqlContext
+	op   *gqlOperation
+	root *gqlObject
+}
+
+// prepare parses query, picks the operation and validates it against the schema
+func (s *gqlSchema) prepare(ctx *gqlContext, query, operationName string, variables map[string]interface{}) (*gqlRequest, error) {
+	if len(query) > gqlMaxQueryBytes {
+		return nil, fmt.Errorf("the query is longer than %d bytes", gqlMaxQueryBytes)
+	}
+	doc, err := gqlParse(query)
+	if err != nil {
+		return nil, fmt.Errorf("syntax error: %v", err)
+	}
+
+	var op *gqlOperation
+	for _, candidate := range doc.operations {
+		if operationName == "" && len(doc.operations) == 1 || candidate.name == operationName {
+			op = candidate
+		}
+	}
+	if op == nil {
+		if operationName == "" {
+			return nil, errors.New("operationName is required for documents with several operations")
+		}
+		return nil, fmt.Errorf("unknown operation %s", operationName)
+	}
+	root := s.root(op.kind)
+	if root == nil {
+		return nil, fmt.Errorf("the schema has no %s type", op.kind)
+	}
+
+	vars := make(map[string]interface{})
+	for _, def := range op.vars {
+		value, given := variables[def.name]
+		if !given && def.fallback != nil {
+			value, given = def.fallback.resolve(nil), true
+		}
+		if (!given || value == nil) && strings.HasSuffix(def.typ, "!") {
+			return nil, fmt.Errorf("variable $%s of type %s is required", def.name, def.typ)
+		}
+		vars[def.name] = value
+	}
+
+	ctx.vars = vars
+	ctx.doc = doc
+	v := &gqlValidator{ctx: ctx}
+	if err := v.selections(root, op.selections, 1, nil); err != nil {
+		return nil, err
+	}
+	if err := v.conflicts(root, op.selections); err != nil {
+		return nil, err
+	}
+	if op.kind == "subscription" {
+		if fields := v.collect(root, op.selections, nil); len(fields) != 1 {
+			return nil, errors.New("a subscription must select exactly one field")
+		}
+	}
+	cost, err := v.cost(root, op.selections, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cost > gqlMaxComplexity {
+		return nil, fmt.Errorf("the query is too complex: it costs %d, at most %d is allowed", cost, gqlMaxComplexity)
+	}
+	return &gqlRequest{ctx: ctx, op: op, root: root}, nil
+}
+
+// gqlValidator checks a document against the schema before it runs
+type gqlValidator struct {
+	ctx *gqlContext
+}
+
+// included evaluates the @skip and @include directives of a selection
+func (v *gqlValidator) included(sel *gqlSelection) bool {
+	if args, ok := sel.directives["skip"]; ok {
+		if cond, _ := args["if"].resolve(v.ctx.vars).(bool); cond {
+			return false
+		}
+	}
+	if args, ok := sel.directives["include"]; ok {
+		if cond, _ := args["if"].resolve(v.ctx.vars).(bool); !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// collect returns the fields selected on object in order, with fragments flattened
+// and the fields of the same response key merged into one: the first of them,
+// selecting the subfields of all of them.
+func (v *gqlValidator) collect(object *gqlObject, selections []*gqlSelection, visiting map[string]bool) []*gqlSelection {
+	var fields []*gqlSelection
+	index := make(map[string]int)
+	copied := make(map[string]bool)
+	for _, sel := range v.flatten(object, selections, visiting) {
+		key := sel.key()
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(fields)
+			fields = append(fields, sel)
+			continue
+		}
+		if len(sel.selections) == 0 {
+			continue
+		}
+		// Copy before merging, the first selection is part of the document
+		if !copied[key] {
+			merged := *fields[i]
+			merged.selections = append([]*gqlSelection(nil), merged.selections...)
+			fields[i] = &merged
+			copied[key] = true
+		}
+		fields[i].selections = append(fields[i].selections, sel.selections...)
+	}
+	return fields
+}
+
+// flatten returns the fields selected on object in order, expanding fragments.
+// visiting holds the fragments being expanded, to stop fragment cycles.
+func (v *gqlValidator) flatten(object *gqlObject, selections []*gqlSelection, visiting map[string]bool) []*gqlSelection {
+	var fields []*gqlSelection
+	for _, sel := range selections {
+		if !v.included(sel) {
+			continue
+		}
+		switch {
+		case sel.spread != "":
+			frag := v.ctx.doc.fragments[sel.spread]
+			if frag == nil || visiting[sel.spread] || frag.typeCond != object.Name {
+				continue
+			}
+			inner := map[string]bool{sel.spread: true}
+			for name := range visiting {
+				inner[name] = true
+			}
+			fields = append(fields, v.flatten(object, frag.selections, inner)...)
+		case sel.inline:
+			if sel.typeCond == "" || sel.typeCond == object.Name {
+				fields = append(fields, v.flatten(object, sel.selections, visiting)...)
+			}
+		default:
+			fields = append(fields, sel)
+		}
+	}
+	return fields
+}
+
+// selections checks that every field exists with valid arguments and that
+// objects, and only objects, have a selection set
+func (v *gqlValidator) selections(object *gqlObject, selections []*gqlSelection, depth int, visiting map[string]bool) error {
+	if depth > gqlMaxDepth {
+		return fmt.Errorf("the query is nested deeper than %d levels", gqlMaxDepth)
+	}
+	for _, sel := range selections {
+		if sel.spread != "" {
+			frag, ok := v.ctx.doc.fragments[sel.spread]
+			if !ok {
+				return fmt.Errorf("unknown fragment %s", sel.spread)
+			}
+			if visiting[sel.spread] {
+				return fmt.Errorf("fragment %s spreads itself", sel.spread)
+			}
+			if frag.typeCond != object.Name {
+				return fmt.Errorf("fragment %s on %s can't be spread on %s", sel.spread, frag.typeCond, object.Name)
+			}
+			inner := map[string]bool{sel.spread: true}
+			for name := range visiting {
+				inner[name] = true
+			}
+			if err := v.selections(object, frag.selections, depth, inner); err != nil {
+				return err
+			}
+			continue
+		}
+		if sel.inline {
+			if sel.typeCond != "" && sel.typeCond != object.Name {
+				return fmt.Errorf("inline fragment on %s can't be used on %s", sel.typeCond, object.Name)
+			}
+			if err := v.selections(object, sel.selections, depth, visiting); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if sel.name == "__typename" {
+			continue
+		}
+		field, ok := object.Fields[sel.name]
+		if !ok {
+			return fmt.Errorf("%s has no field %s", object.Name, sel.name)
+		}
+		for arg := range sel.args {
+			if _, ok := field.Args[arg]; !ok {
+				return fmt.Errorf("field %s.%s has no argument %s", object.Name, sel.name, arg)
+			}
+		}
+		for arg, typ := range field.Args {
+			if value, given := sel.args[arg]; strings.HasSuffix(typ, "!") && (!given || value.resolve(v.ctx.vars) == nil) {
+				return fmt.Errorf("argument %s of field %s.%s is required", arg, object.Name, sel.name)
+			}
+		}
+
+		switch {
+		case field.Object != nil && sel.selections == nil:
+			return fmt.Errorf("field %s.%s of type %s needs a selection of subfields", object.Name, sel.name, field.Type)
+		case field.Object == nil && sel.selections != nil:
+			return fmt.Errorf("field %s.%s of type %s has no subfields", object.Name, sel.name, field.Type)
+		case field.Object != nil:
+			// The introspection types are left out of the depth, introspection queries
+			// nest ofType deeper than gqlMaxDepth. Their cost is still limited.
+			next := depth + 1
+			if strings.HasPrefix(field.Object.Name, "__") {
+				next = depth
+			}
+			if err := v.selections(field.Object, sel.selections, next, visiting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// conflicts checks that the fields selected under the same response key can be
+// merged: they must select the same field with the same arguments, and the
+// subfields they select together must be mergeable as well.
+func (v *gqlValidator) conflicts(object *gqlObject, selections []*gqlSelection) error {
+	var keys []string
+	byKey := make(map[string][]*gqlSelection)
+	for _, sel := range v.flatten(object, selections, nil) {
+		if _, seen := byKey[sel.key()]; !seen {
+			keys = append(keys, sel.key())
+		}
+		byKey[sel.key()] = append(byKey[sel.key()], sel)
+	}
+
+	for _, key := range keys {
+		same := byKey[key]
+		first := same[0]
+		var subfields []*gqlSelection
+		for _, sel := range same {
+			if sel.name != first.name {
+				return fmt.Errorf("%s and %s are both selected as %s on %s, use different aliases", first.name, sel.name, key, object.Name)
+			}
+			if !gqlSameArgs(first.args, sel.args) {
+				return fmt.Errorf("%s.%s is selected as %s with different arguments, use different aliases", object.Name, sel.name, key)
+			}
+			subfields = append(subfields, sel.selections...)
+		}
+		if field := object.Fields[first.name]; field != nil && field.Object != nil {
+			if err := v.conflicts(field.Object, subfields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gqlSameArgs reports whether two argument lists are written the same way
+func gqlSameArgs(a, b map[string]gqlValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || !reflect.DeepEqual(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// cost estimates how expensive a selection is: every field costs 1, and the
+// subfields of a paginated field count once for every item of the page.
+func (v *gqlValidator) cost(object *gqlObject, selections []*gqlSelection, visiting map[string]bool) (int, error) {
+	total := 0
+	for _, sel := range v.collect(object, selections, visiting) {
+		total++
+		field := object.Fields[sel.name]
+		if field == nil || field.Object == nil {
+			continue
+		}
+		inner, err := v.cost(field.Object, sel.selections, visiting)
+		if err != nil {
+			return 0, err
+		}
+		if field.Paginated {
+			first, err := gqlFirst(v.resolveArgs(sel))
+			if err != nil {
+				return 0, err
+			}
+			inner *= first
+		}
+		total += inner
+	}
+	return total, nil
+}
+
+// resolveArgs returns the arguments of a field with variables filled in
+func (v *gqlValidator) resolveArgs(sel *gqlSelection) map[string]interface{} {
+	args := make(map[string]interface{}, len(sel.args))
+	for name, value := range sel.args {
+		args[name] = value.resolve(v.ctx.vars)
+	}
+	return args
+}
+
+// execute runs a query or mutation. Mutation fields run one after the other, as
+// the specification demands; the executor runs query fields in order as well.
+func (req *gqlRequest) execute() gqlResponse {
+	data := req.object(req.root, nil, req.op.selections, nil)
+	return gqlResponse{Data: data, Errors: req.ctx.errors}
+}
+
+// resolveEvent resolves the selection of a subscription against one event
+func (req *gqlRequest) resolveEvent(field *gqlSelection, event interface{}) gqlResponse {
+	req.ctx.errors = nil
+	object := req.root.Fields[field.name].Object
+	var value interface{}
+	if event != nil {
+		value = req.object(object, event, field.selections, []interface{}{field.key()})
+	}
+	return gqlResponse{Data: map[string]interface{}{field.key(): value}, Errors: req.ctx.errors}
+}
+
+// object resolves the selections on source, an instance of object
+func (req *gqlRequest) object(object *gqlObject, source interface{}, selections []*gqlSelection, path []interface{}) map[string]interface{} {
+	v := &gqlValidator{ctx: req.ctx}
+	result := make(map[string]interface{})
+	for _, sel := range v.collect(object, selections, nil) {
+		key := sel.key()
+		if sel.name == "__typename" {
+			result[key] = object.Name
+			continue
+		}
+
+		fieldPath := append(append([]interface{}(nil), path...), key)
+		field := object.Fields[sel.name]
+		value, err := field.Resolve(req.ctx, source, v.resolveArgs(sel))
+		if err != nil {
+			req.ctx.errors = append(req.ctx.errors, gqlError{Message: err.Error(), Path: fieldPath})
+			result[key] = nil
+			continue
+		}
+		result[key] = req.value(field, value, sel, fieldPath)
+	}
+	return result
+}
+
+// value completes the resolved value of a field: objects are resolved further,
+// lists of objects item by item, and scalars are returned as they are.
+func (req *gqlRequest) value(field *gqlField, value interface{}, sel *gqlSelection, path []interface{}) interface{} {
+	if field.Object == nil || value == nil {
+		return value
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	if rv.Kind() != reflect.Slice {
+		return req.object(field.Object, value, sel.selections, path)
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = req.object(field.Object, rv.Index(i).Interface(), sel.selections, append(path, i))
+	}
+	return list
+}
+
+// Argument helpers for resolvers
+
+// gqlFirst returns the page size of a paginated field
+func gqlFirst(args map[string]interface{}) (int, error) {
+	first, err := gqlIntArg(args, "first")
+	if err != nil {
+		return 0, err
+	}
+	if _, given := args["first"]; !given || args["first"] == nil {
+		return gqlDefaultFirst, nil
+	}
+	if first < 1 || first > gqlMaxFirst {
+		return 0, fmt.Errorf("first must be between 1 and %d", gqlMaxFirst)
+	}
+	return first, nil
+}
+
+// gqlStringArg returns a string or ID argument, "" if it was not given
+func gqlStringArg(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	return "", fmt.Errorf("argument %s must be a string", name)
+}
+
+// gqlIntArg returns an integer argument, 0 if it was not given. JSON variables
+// arrive as float64 and are accepted if they are whole numbers.
+func gqlIntArg(args map[string]interface{}, name string) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return v, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %s must be an integer", name)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The GraphQL schema over users, conversations and messages. Resolvers apply the
+// same rules as the REST endpoints they mirror, mostly by calling the same code.
+
+// gqlConnection is one page of a paginated field
+type gqlConnection struct {
+	Nodes       interface{}
+	TotalCount  int
+	EndCursor   string
+	HasNextPage bool
+}
+
+// gqlSendResult is the result of the sendMessage mutation
+type gqlSendResult struct {
+	Status  string   // DELIVERED, or HELD_FOR_REVIEW if moderation flagged the message
+	Message *Message // The delivered message, nil while it is held
+}
+
+// gqlProp returns a field without arguments resolving to get(source)
+func gqlProp(typ, description string, get func(source interface{}) interface{}) *gqlField {
+	return &gqlField{
+		Type:        typ,
+		Description: description,
+		Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return get(source), nil
+		},
+	}
+}
+
+// gqlOptional turns an empty string into null
+func gqlOptional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// gqlUser resolves a user ID to the user, or null if there is no such user
+func gqlUser(id string) (interface{}, error) {
+	user, err := userRepo.Get(id)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, repoProblem(err)
+	}
+	return user.InternData, nil
+}
+
+// gqlMessagePage cuts the page selected by the first and after arguments out of msgs.
+// The cursor of a message is its ID.
+func (cs *ChatService) gqlMessagePage(msgs []Message, args map[string]interface{}) (interface{}, error) {
+	first, err := gqlFirst(args)
+	if err != nil {
+		return nil, err
+	}
+	after, err := gqlStringArg(args, "after")
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if after != "" {
+		start = -1
+		for i, msg := range msgs {
+			if msg.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, errors.New("after is not the cursor of a message on this list")
+		}
+	}
+	end := start + first
+	if end > len(msgs) {
+		end = len(msgs)
+	}
+
+	page := cs.withReplyCounts(msgs[start:end])
+	conn := gqlConnection{Nodes: page, TotalCount: len(msgs), HasNextPage: end < len(msgs)}
+	if len(page) > 0 {
+		conn.EndCursor = page[len(page)-1].ID
+	}
+	return conn, nil
+}
+
+// newGraphQLSchema builds the schema served at /graphql
+func newGraphQLSchema() *gqlSchema {
+	pageArgs := map[string]string{"first": "Int", "after": "String"}
+	withPageArgs := func(args map[string]string) map[string]string {
+		for name, typ := range pageArgs {
+			args[name] = typ
+		}
+		return args
+	}
+
+	userType := &gqlObject{Name: "User", Description: "A user of the chat", Fields: map[string]*gqlField{
+		"id":        gqlProp("ID!", "", func(s interface{}) interface{} { return s.(User).ID }),
+		"name":      gqlProp("String!", "", func(s interface{}) interface{} { return s.(User).Name }),
+		"createdAt": gqlProp("String!", "RFC 3339 timestamp", func(s interface{}) interface{} { return s.(User).CreatedAt.Format(time.RFC3339Nano) }),
+		"version":   gqlProp("Int!", "Pass to updateUser, like the ETag to PUT /users/{id}", func(s interface{}) interface{} { return s.(User).Version }),
+	}}
+
+	messageType := &gqlObject{Name: "Message", Description: "A chat message", Fields: map[string]*gqlField{
+		"id":         gqlProp("ID!", "", func(s interface{}) interface{} { return s.(Message).ID }),
+		"senderId":   gqlProp("ID!", "", func(s interface{}) interface{} { return s.(Message).SenderID }),
+		"receiverId": gqlProp("ID!", "", func(s interface{}) interface{} { return s.(Message).ReceiverID }),
+		"text":       gqlProp("String!", "Empty for encrypted messages", func(s interface{}) interface{} { return s.(Message).Message }),
+		"encrypted":  gqlProp("Boolean!", "", func(s interface{}) interface{} { return s.(Message).IsEncrypted() }),
+		"timestamp":  gqlProp("String!", "RFC 3339 timestamp", func(s interface{}) interface{} { return s.(Message).TimeStamp.Format(time.RFC3339Nano) }),
+		"replyTo":    gqlProp("ID", "", func(s interface{}) interface{} { return gqlOptional(s.(Message).ReplyTo) }),
+		"replyCount": gqlProp("Int!", "", func(s interface{}) interface{} { return s.(Message).ReplyCount }),
+		"pollId":     gqlProp("ID", "", func(s interface{}) interface{} { return gqlOptional(s.(Message).PollID) }),
+		"sender": {Type: "User", Description: "Null for system messages", Object: userType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				return gqlUser(s.(Message).SenderID)
+			}},
+		"receiver": {Type: "User", Object: userType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				return gqlUser(s.(Message).ReceiverID)
+			}},
+	}}
+
+	pageInfoType := &gqlObject{Name: "PageInfo", Fields: map[string]*gqlField{
+		"endCursor":   gqlProp("String", "Pass as after to get the next page", func(s interface{}) interface{} { return gqlOptional(s.(gqlConnection).EndCursor) }),
+		"hasNextPage": gqlProp("Boolean!", "", func(s interface{}) interface{} { return s.(gqlConnection).HasNextPage }),
+	}}
+	connection := func(name string, node *gqlObject) *gqlObject {
+		return &gqlObject{Name: name, Fields: map[string]*gqlField{
+			"nodes": {Type: "[" + node.Name + "!]!", Object: node, Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				return s.(gqlConnection).Nodes, nil
+			}},
+			"totalCount": gqlProp("Int!", "", func(s interface{}) interface{} { return s.(gqlConnection).TotalCount }),
+			"pageInfo":   {Type: "PageInfo!", Object: pageInfoType, Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) { return s, nil }},
+		}}
+	}
+	userConnection := connection("UserConnection", userType)
+	messageConnection := connection("MessageConnection", messageType)
+
+	sendResultType := &gqlObject{Name: "SendMessageResult", Fields: map[string]*gqlField{
+		"status": gqlProp("String!", "DELIVERED, or HELD_FOR_REVIEW if moderation flagged the message", func(s interface{}) interface{} { return s.(gqlSendResult).Status }),
+		"message": {Type: "Message", Description: "Null while the message is held for review", Object: messageType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				if msg := s.(gqlSendResult).Message; msg != nil {
+					return *msg, nil
+				}
+				return nil, nil
+			}},
+	}}
+
+	query := &gqlObject{Name: "Query", Fields: map[string]*gqlField{
+		"me": {Type: "User", Description: "The user of the JWT in the Authorization header", Object: userType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				if ctx.claims == nil {
+					return nil, errors.New("a valid JWT is required in the Authorization header")
+				}
+				user, err := userRepo.GetByName(ctx.claims.Username)
+				if err != nil {
+					return nil, repoProblem(err)
+				}
+				return user.InternData, nil
+			}},
+		"user": {Type: "User", Args: map[string]string{"id": "ID!"}, Object: userType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				id, err := gqlStringArg(args, "id")
+				if err != nil {
+					return nil, err
+				}
+				return gqlUser(id)
+			}},
+		"users": {Type: "UserConnection!", Description: "Users like GET /users, search is a name prefix and sort uses its syntax",
+			Args: withPageArgs(map[string]string{"search": "String", "sort": "String"}), Object: userConnection, Paginated: true,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				first, err := gqlFirst(args)
+				if err != nil {
+					return nil, err
+				}
+				values := url.Values{"limit": {strconv.Itoa(first)}}
+				for arg, param := range map[string]string{"after": "cursor", "search": "q", "sort": "sort"} {
+					value, err := gqlStringArg(args, arg)
+					if err != nil {
+						return nil, err
+					}
+					if value != "" {
+						values.Set(param, value)
+					}
+				}
+				q, err := ParseUserQuery(values)
+				if err != nil {
+					return nil, err
+				}
+
+				stored, err := userRepo.List()
+				if err != nil {
+					return nil, repoProblem(err)
+				}
+				all := make([]User, 0, len(stored))
+				for _, user := range stored {
+					all = append(all, user.InternData)
+				}
+				page, total, next := q.Apply(all)
+				return gqlConnection{Nodes: page, TotalCount: total, EndCursor: next, HasNextPage: next != ""}, nil
+			}},
+		"messages": {Type: "MessageConnection!", Description: "Messages received by a user, like GET /messages/{id}. Only for the user and admins.",
+			Args: withPageArgs(map[string]string{"userId": "ID!"}), Object: messageConnection, Paginated: true,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				userID, err := gqlStringArg(args, "userId")
+				if err != nil {
+					return nil, err
+				}
+				if p := ctx.cs.participantProblem(ctx.claims, userID); p != nil {
+					return nil, p
+				}
+				return ctx.cs.gqlMessagePage(ctx.cs.GetMessagesForUser(userID), args)
+			}},
+		"conversation": {Type: "MessageConnection!", Description: "Messages between two users, like GET /conversations/{a}:{b}/messages. Only for the two users and admins.",
+			Args: withPageArgs(map[string]string{"userA": "ID!", "userB": "ID!"}), Object: messageConnection, Paginated: true,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				userA, err := gqlStringArg(args, "userA")
+				if err != nil {
+					return nil, err
+				}
+				userB, err := gqlStringArg(args, "userB")
+				if err != nil {
+					return nil, err
+				}
+				if p := ctx.cs.participantProblem(ctx.claims, userA, userB); p != nil {
+					return nil, p
+				}
+				return ctx.cs.gqlMessagePage(ctx.cs.GetConversation(userA, userB), args)
+			}},
+		"thread": {Type: "[Message!]", Description: "A message and all replies below it, like GET /threads/{id}. Only for the two users of the conversation and admins.",
+			Args: map[string]string{"id": "ID!"}, Object: messageType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				id, err := gqlStringArg(args, "id")
+				if err != nil {
+					return nil, err
+				}
+				if ctx.claims == nil {
+					return nil, errors.New("a valid JWT is required in the Authorization header")
+				}
+				thread, ok := ctx.cs.GetThread(id)
+				if !ok {
+					return nil, nil
+				}
+				if p := ctx.cs.participantProblem(ctx.claims, thread[0].SenderID, thread[0].ReceiverID); p != nil {
+					return nil, p
+				}
+				return ctx.cs.withReplyCounts(thread), nil
+			}},
+	}}
+
+	mutation := &gqlObject{Name: "Mutation", Fields: map[string]*gqlField{
+		"sendMessage": {Type: "SendMessageResult!", Description: "Sends a plain text message as the caller, like POST /messages. Only admins may give another senderId.",
+			Args: map[string]string{"senderId": "ID", "receiverId": "ID!", "text": "String!", "replyTo": "ID"}, Object: sendResultType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				var msg Message
+				for arg, target := range map[string]*string{"senderId": &msg.SenderID, "receiverId": &msg.ReceiverID, "text": &msg.Message, "replyTo": &msg.ReplyTo} {
+					value, err := gqlStringArg(args, arg)
+					if err != nil {
+						return nil, err
+					}
+					*target = value
+				}
+				return ctx.cs.gqlSendMessage(ctx, msg)
+			}},
+		"updateUser": {Type: "User!", Description: "Renames a user, like PATCH /users/{id}. Allowed for admins and the user themselves, version must be the current one.",
+			Args: map[string]string{"id": "ID!", "name": "String!", "version": "Int!"}, Object: userType,
+			Resolve: func(ctx *gqlContext, s interface{}, args map[string]interface{}) (interface{}, error) {
+				id, err := gqlStringArg(args, "id")
+				if err != nil {
+					return nil, err
+				}
+				name, err := gqlStringArg(args, "name")
+				if err != nil {
+					return nil, err
+				}
+				version, err := gqlIntArg(args, "version")
+				if err != nil {
+					return nil, err
+				}
+				return ReplaceUser(ctx.claims, User{ID: id, Name: name, Version: version})
+			}},
+	}}
+
+	subscription := &gqlObject{Name: "Subscription", Fields: map[string]*gqlField{
+		"messageAdded": {Type: "Message!", Description: "Every message sent or received by a user, like GET /messages/{id}/stream. Only for the user and admins.",
+			Args: map[string]string{"userId": "ID!"}, Object: messageType,
+			Subscribe: func(ctx *gqlContext, args map[string]interface{}) (<-chan interface{}, func(), error) {
+				userID, err := gqlStringArg(args, "userId")
+				if err != nil {
+					return nil, nil, err
+				}
+				if p := ctx.cs.participantProblem(ctx.claims, userID); p != nil {
+					return nil, nil, p
+				}
+				events, cancel := ctx.cs.broker.Subscribe()
+				out := make(chan interface{})
+				go func() {
+					defer close(out)
+					for event := range events {
+						msg := event.Message
+						if event.Kind == EventMessage && (msg.SenderID == userID || msg.ReceiverID == userID) {
+							out <- msg
+						}
+					}
+				}()
+				stop := func() {
+					cancel()
+					for range out {
+						// Let the forwarding goroutine finish
+					}
+				}
+				return out, stop, nil
+			}},
+	}}
+
+	return newGQLSchema(query, mutation, subscription)
+}
+
+// graphQLSchema is the schema served at /graphql
+var graphQLSchema = newGraphQLSchema()
+
+// gqlSendMessage sends msg as the caller with the checks of SendMessageHandler
+func (cs *ChatService) gqlSendMessage(ctx *gqlContext, msg Message) (interface{}, error) {
+	senderID, p := cs.senderFor(ctx.claims, msg.SenderID)
+	if p != nil {
+		return nil, p
+	}
+	msg.SenderID = senderID
+	stored, err := cs.SendChecked(msg, ctx.claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return gqlSendResult{Status: "HELD_FOR_REVIEW"}, nil
+	}
+	return gqlSendResult{Status: "DELIVERED", Message: stored}, nil
+}
+
+// HTTP Handlers
+
+// GraphQLHandler serves /graphql. Queries come as GET or POST, mutations only as POST,
+// with query, operationName and variables in the query string or a JSON body.
+// Subscriptions are answered with server-sent events: a "next" event carrying a
+// GraphQL response for every new item, and a "complete" event when the stream ends.
+func (cs *ChatService) GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if r.Method == http.MethodGet {
+		params.Query = r.URL.Query().Get("query")
+		params.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &params.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*gqlMaxQueryBytes)).Decode(&params); err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, "The request body must be a JSON object with a query")
+		return
+	}
+	if params.Query == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "query is missing")
+		return
+	}
+
+	ctx := &gqlContext{cs: cs}
+	if claims, err := ClaimsFromRequest(r); err == nil {
+		ctx.claims = claims
+	}
+	req, err := graphQLSchema.prepare(ctx, params.Query, params.OperationName, params.Variables)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.op.kind == "mutation" && r.Method == http.MethodGet {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "mutations must be sent with POST")
+		return
+	}
+
+	if req.op.kind == "subscription" {
+		cs.serveGraphQLSubscription(w, r, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req.execute())
+}
+
+// serveGraphQLSubscription streams the events of a subscription until the client leaves
+func (cs *ChatService) serveGraphQLSubscription(w http.ResponseWriter, r *http.Request, req *gqlRequest) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeGraphQLError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	v := &gqlValidator{ctx: req.ctx}
+	sel := v.collect(req.root, req.op.selections, nil)[0]
+	events, stop, err := req.root.Fields[sel.name].Subscribe(req.ctx, v.resolveArgs(sel))
+	if err != nil {
+		status := http.StatusBadRequest
+		var p *Problem
+		if errors.As(err, &p) {
+			status = p.Status
+		}
+		writeGraphQLError(w, status, err.Error())
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				flusher.Flush()
+				return
+			}
+			data, err := json.Marshal(req.resolveEvent(sel, event))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// GraphQLSchemaHandler serves the schema of /graphql in the schema definition language
+func GraphQLSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, graphQLSchema.SDL())
+}
+
+// writeGraphQLError answers a request that could not be executed
+func writeGraphQLError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(gqlResponse{Errors: []gqlError{{Message: message}}})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Introspection: the __schema and __type fields of the query type, and the
+// __Schema, __Type, __Field, __InputValue, __EnumValue and __Directive types they
+// return, so tools like GraphiQL can load the schema. The introspection types are
+// ordinary objects of the schema; SDL leaves them out.
+
+// gqlType is a type as introspection describes it: a named scalar, enum or
+// object, or a list or non-null wrapper around another type.
+type gqlType struct {
+	Kind        string // SCALAR, OBJECT, ENUM, LIST or NON_NULL
+	Name        string // Empty for LIST and NON_NULL
+	Description string
+	Object      *gqlObject // Set for OBJECT
+	EnumValues  []string   // Set for ENUM
+	OfType      *gqlType   // Set for LIST and NON_NULL
+}
+
+// gqlFieldInfo describes a field of an object type
+type gqlFieldInfo struct {
+	Name        string
+	Description string
+	Args        []gqlInputValue
+	Type        *gqlType
+}
+
+// gqlInputValue describes an argument
+type gqlInputValue struct {
+	Name string
+	Type *gqlType
+}
+
+// gqlEnumValue describes a value of an enum type
+type gqlEnumValue struct {
+	Name string
+}
+
+// gqlDirective describes a directive the engine supports
+type gqlDirective struct {
+	Name        string
+	Description string
+	Locations   []string
+	Args        []gqlInputValue
+}
+
+// gqlIntrospectionEnums are the enum types of introspection, the schema itself has none
+var gqlIntrospectionEnums = map[string][]string{
+	"__TypeKind":          {"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL"},
+	"__DirectiveLocation": {"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+}
+
+// typeRef returns the introspection form of a type like [Message!]!
+func (s *gqlSchema) typeRef(typ string) *gqlType {
+	if strings.HasSuffix(typ, "!") {
+		return &gqlType{Kind: "NON_NULL", OfType: s.typeRef(strings.TrimSuffix(typ, "!"))}
+	}
+	if strings.HasPrefix(typ, "[") && strings.HasSuffix(typ, "]") {
+		return &gqlType{Kind: "LIST", OfType: s.typeRef(typ[1 : len(typ)-1])}
+	}
+	return s.types[typ]
+}
+
+// gqlTypeName strips the list and non-null markers from a type
+func gqlTypeName(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// fieldInfos describes the fields of an object, sorted by name
+func (s *gqlSchema) fieldInfos(object *gqlObject) []gqlFieldInfo {
+	infos := make([]gqlFieldInfo, 0, len(object.Fields))
+	for name, field := range object.Fields {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		infos = append(infos, gqlFieldInfo{Name: name, Description: field.Description, Args: s.inputValues(field.Args), Type: s.typeRef(field.Type)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// inputValues describes arguments, sorted by name
+func (s *gqlSchema) inputValues(args map[string]string) []gqlInputValue {
+	values := make([]gqlInputValue, 0, len(args))
+	for name, typ := range args {
+		values = append(values, gqlInputValue{Name: name, Type: s.typeRef(typ)})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+// addIntrospection adds the __schema and __type fields to the query type and
+// indexes the named types they describe
+func (s *gqlSchema) addIntrospection() {
+	schemaType := &gqlObject{Name: "__Schema", Description: "The types and directives of the schema"}
+	typeType := &gqlObject{Name: "__Type", Description: "A type of the schema, or a list or non-null wrapper around one"}
+	fieldType := &gqlObject{Name: "__Field", Description: "A field of an object type"}
+	inputValueType := &gqlObject{Name: "__InputValue", Description: "An argument of a field or directive"}
+	enumValueType := &gqlObject{Name: "__EnumValue", Description: "A value of an enum type"}
+	directiveType := &gqlObject{Name: "__Directive", Description: "A directive the server supports"}
+
+	// Deprecation is not used by the schema, so these fields are the same everywhere
+	notDeprecated := gqlProp("Boolean!", "", func(interface{}) interface{} { return false })
+	noReason := gqlProp("String", "", func(interface{}) interface{} { return nil })
+	includeDeprecated := map[string]string{"includeDeprecated": "Boolean"}
+
+	schemaType.Fields = map[string]*gqlField{
+		"description": gqlProp("String", "", func(interface{}) interface{} { return nil }),
+		"types": {Type: "[__Type!]!", Object: typeType, Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			names := make([]string, 0, len(s.types))
+			for name := range s.types {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			types := make([]*gqlType, len(names))
+			for i, name := range names {
+				types[i] = s.types[name]
+			}
+			return types, nil
+		}},
+		"queryType": {Type: "__Type!", Object: typeType, Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return s.types[s.Query.Name], nil
+		}},
+		"mutationType": {Type: "__Type", Object: typeType, Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if s.Mutation == nil {
+				return nil, nil
+			}
+			return s.types[s.Mutation.Name], nil
+		}},
+		"subscriptionType": {Type: "__Type", Object: typeType, Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if s.Subscription == nil {
+				return nil, nil
+			}
+			return s.types[s.Subscription.Name], nil
+		}},
+		"directives": {Type: "[__Directive!]!", Object: directiveType, Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			condition := []gqlInputValue{{Name: "if", Type: s.typeRef("Boolean!")}}
+			locations := []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}
+			return []gqlDirective{
+				{Name: "include", Description: "Only include this selection if the argument is true", Locations: locations, Args: condition},
+				{Name: "skip", Description: "Leave this selection out if the argument is true", Locations: locations, Args: condition},
+			}, nil
+		}},
+	}
+
+	typeType.Fields = map[string]*gqlField{
+		"kind":           gqlProp("__TypeKind!", "", func(t interface{}) interface{} { return t.(*gqlType).Kind }),
+		"name":           gqlProp("String", "", func(t interface{}) interface{} { return gqlOptional(t.(*gqlType).Name) }),
+		"description":    gqlProp("String", "", func(t interface{}) interface{} { return gqlOptional(t.(*gqlType).Description) }),
+		"specifiedByURL": gqlProp("String", "", func(interface{}) interface{} { return nil }),
+		"isOneOf":        gqlProp("Boolean", "", func(interface{}) interface{} { return nil }),
+		"fields": {Type: "[__Field!]", Args: includeDeprecated, Object: fieldType, Resolve: func(ctx *gqlContext, t interface{}, args map[string]interface{}) (interface{}, error) {
+			if object := t.(*gqlType).Object; object != nil {
+				return s.fieldInfos(object), nil
+			}
+			return nil, nil
+		}},
+		"interfaces": {Type: "[__Type!]", Object: typeType, Resolve: func(ctx *gqlContext, t interface{}, args map[string]interface{}) (interface{}, error) {
+			if t.(*gqlType).Kind == "OBJECT" {
+				return []*gqlType{}, nil
+			}
+			return nil, nil
+		}},
+		"possibleTypes": {Type: "[__Type!]", Object: typeType, Resolve: func(ctx *gqlContext, t interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+		"enumValues": {Type: "[__EnumValue!]", Args: includeDeprecated, Object: enumValueType, Resolve: func(ctx *gqlContext, t interface{}, args map[string]interface{}) (interface{}, error) {
+			if t.(*gqlType).Kind != "ENUM" {
+				return nil, nil
+			}
+			values := make([]gqlEnumValue, len(t.(*gqlType).EnumValues))
+			for i, name := range t.(*gqlType).EnumValues {
+				values[i] = gqlEnumValue{Name: name}
+			}
+			return values, nil
+		}},
+		"inputFields": {Type: "[__InputValue!]", Args: includeDeprecated, Object: inputValueType, Resolve: func(ctx *gqlContext, t interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, nil
+		}},
+		"ofType": {Type: "__Type", Object: typeType, Resolve: func(ctx *gqlContext, t interface{}, args map[string]interface{}) (interface{}, error) {
+			return t.(*gqlType).OfType, nil
+		}},
+	}
+
+	fieldType.Fields = map[string]*gqlField{
+		"name":        gqlProp("String!", "", func(f interface{}) interface{} { return f.(gqlFieldInfo).Name }),
+		"description": gqlProp("String", "", func(f interface{}) interface{} { return gqlOptional(f.(gqlFieldInfo).Description) }),
+		"args": {Type: "[__InputValue!]!", Args: includeDeprecated, Object: inputValueType, Resolve: func(ctx *gqlContext, f interface{}, args map[string]interface{}) (interface{}, error) {
+			return f.(gqlFieldInfo).Args, nil
+		}},
+		"type": {Type: "__Type!", Object: typeType, Resolve: func(ctx *gqlContext, f interface{}, args map[string]interface{}) (interface{}, error) {
+			return f.(gqlFieldInfo).Type, nil
+		}},
+		"isDeprecated":      notDeprecated,
+		"deprecationReason": noReason,
+	}
+
+	inputValueType.Fields = map[string]*gqlField{
+		"name":        gqlProp("String!", "", func(v interface{}) interface{} { return v.(gqlInputValue).Name }),
+		"description": gqlProp("String", "", func(interface{}) interface{} { return nil }),
+		"type": {Type: "__Type!", Object: typeType, Resolve: func(ctx *gqlContext, v interface{}, args map[string]interface{}) (interface{}, error) {
+			return v.(gqlInputValue).Type, nil
+		}},
+		"defaultValue":      gqlProp("String", "", func(interface{}) interface{} { return nil }),
+		"isDeprecated":      notDeprecated,
+		"deprecationReason": noReason,
+	}
+
+	enumValueType.Fields = map[string]*gqlField{
+		"name":              gqlProp("String!", "", func(v interface{}) interface{} { return v.(gqlEnumValue).Name }),
+		"description":       gqlProp("String", "", func(interface{}) interface{} { return nil }),
+		"isDeprecated":      notDeprecated,
+		"deprecationReason": noReason,
+	}
+
+	directiveType.Fields = map[string]*gqlField{
+		"name":         gqlProp("String!", "", func(d interface{}) interface{} { return d.(gqlDirective).Name }),
+		"description":  gqlProp("String", "", func(d interface{}) interface{} { return gqlOptional(d.(gqlDirective).Description) }),
+		"locations":    gqlProp("[__DirectiveLocation!]!", "", func(d interface{}) interface{} { return d.(gqlDirective).Locations }),
+		"isRepeatable": gqlProp("Boolean!", "", func(interface{}) interface{} { return false }),
+		"args": {Type: "[__InputValue!]!", Args: includeDeprecated, Object: inputValueType, Resolve: func(ctx *gqlContext, d interface{}, args map[string]interface{}) (interface{}, error) {
+			return d.(gqlDirective).Args, nil
+		}},
+	}
+
+	s.Query.Fields["__schema"] = &gqlField{Type: "__Schema!", Description: "Describes the schema", Object: schemaType,
+		Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return s, nil
+		}}
+	s.Query.Fields["__type"] = &gqlField{Type: "__Type", Description: "Describes the named type, null if there is none", Args: map[string]string{"name": "String!"}, Object: typeType,
+		Resolve: func(ctx *gqlContext, source interface{}, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			return s.types[name], nil
+		}}
+
+	// Named types: the objects, the introspection enums, and every other type a
+	// field or argument refers to is a scalar
+	s.types = make(map[string]*gqlType)
+	objects := s.objects()
+	for name, object := range objects {
+		s.types[name] = &gqlType{Kind: "OBJECT", Name: name, Description: object.Description, Object: object}
+	}
+	for name, values := range gqlIntrospectionEnums {
+		s.types[name] = &gqlType{Kind: "ENUM", Name: name, EnumValues: values}
+	}
+	for _, object := range objects {
+		for _, field := range object.Fields {
+			refs := []string{field.Type}
+			for _, typ := range field.Args {
+				refs = append(refs, typ)
+			}
+			for _, ref := range refs {
+				if name := gqlTypeName(ref); s.types[name] == nil {
+					s.types[name] = &gqlType{Kind: "SCALAR", Name: name}
+				}
+			}
+		}
+	}
+}
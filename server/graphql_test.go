@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newGraphQLTestService creates a ChatService with the users alice (1), bob (2) and
+// carol (3, admin), and alice's message "hi" to bob with bob's reply to it
+func newGraphQLTestService(t *testing.T) (*ChatService, string) {
+	t.Helper()
+	userRepo = NewMemoryUserRepository()
+	cs := NewChatService()
+	for _, u := range []struct{ id, name string }{{"1", "alice"}, {"2", "bob"}, {"3", "carol"}} {
+		if err := cs.RegisterUser(u.id, u.name, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs.SetRole("3", "admin")
+
+	root, err := cs.deliver(CreateMessage("1", "2", "hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := CreateMessage("2", "1", "hello")
+	reply.ReplyTo = root.ID
+	if err := cs.Deliver(reply); err != nil {
+		t.Fatal(err)
+	}
+	return cs, root.ID
+}
+
+// gqlClaims returns the claims of a user, nil for an empty name
+func gqlClaims(name, role string) *Claims {
+	if name == "" {
+		return nil
+	}
+	return &Claims{Username: name, Role: role}
+}
+
+// runGraphQL prepares and executes query as the user of claims. It fails the test
+// if the query does not pass validation.
+func runGraphQL(t *testing.T, cs *ChatService, claims *Claims, query string, vars map[string]interface{}) gqlResponse {
+	t.Helper()
+	req, err := graphQLSchema.prepare(&gqlContext{cs: cs, claims: claims}, query, "", vars)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return req.execute()
+}
+
+// gqlJSON encodes the data of a response, the maps come out sorted by key
+func gqlJSON(t *testing.T, resp gqlResponse) string {
+	t.Helper()
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGraphQLParse(t *testing.T) {
+	valid := []string{
+		`{ me { id } }`,
+		`query Q($id: ID!, $first: Int = 5) { user(id: $id) { name } users(first: $first) { totalCount } }`,
+		`mutation { sendMessage(senderId: "1", receiverId: "2", text: "a \"quoted\" text") { status } }`,
+		`{ ...F } fragment F on Query { me { id } }`,
+		`{ me { ... on User { name } ... @skip(if: true) { id } } }`,
+		`{ users(sort: "name") { nodes { id } } } # a comment`,
+		`{ a: me { id } b: me { name } }`,
+		"{ me { id } }\n\n\t",
+		`{ user(id: "1") { name @include(if: false) } }`,
+		`query { users(first: 1) { nodes { name } } }`,
+		`{ f(list: [1, 2.5, "x", true, null, ENUM], obj: {a: 1, b: {c: []}}) }`,
+		`subscription S { messageAdded(userId: "1") { id } }`,
+		`{ s: user(id: """block "string" """) { id } }`,
+	}
+	for _, query := range valid {
+		if _, err := gqlParse(query); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+
+	invalid := []string{
+		``,
+		`{`,
+		`{ me { id }`,
+		`{ me(id: ) { id } }`,
+		`{ me(id: "unterminated) { id } }`,
+		`query ($x: ) { me { id } }`,
+		`{ me } }`,
+		`fragment F on Query { me { id } }`,
+		`{ ...F } fragment F { me { id } }`,
+		`{ 1abc }`,
+		`query ($x: Int = $y) { me { id } }`,
+	}
+	for _, query := range invalid {
+		if _, err := gqlParse(query); err == nil {
+			t.Errorf("%q parsed without an error", query)
+		}
+	}
+}
+
+func TestGraphQLValidation(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+	tests := []struct {
+		query string
+		err   string // Part of the expected error, empty if the query is valid
+	}{
+		{`{ me { id } }`, ""},
+		{`{ nope }`, "Query has no field nope"},
+		{`{ user { id } }`, "argument id of field Query.user is required"},
+		{`{ user(id: "1", extra: 1) { id } }`, "has no argument extra"},
+		{`{ me }`, "needs a selection of subfields"},
+		{`{ me { id { x } } }`, "has no subfields"},
+		{`{ ...Missing }`, "unknown fragment Missing"},
+		{`{ ...F } fragment F on User { id }`, "can't be spread on Query"},
+		{`{ ...F } fragment F on Query { ...F }`, "spreads itself"},
+		{`{ ... on User { id } }`, "can't be used on Query"},
+		{`mutation { me { id } }`, "Mutation has no field me"},
+		{`subscription { a: messageAdded(userId: "1") { id } b: messageAdded(userId: "2") { id } }`, "exactly one field"},
+		{`{ users(first: 100) { nodes { id name createdAt version } } messages(userId: "1", first: 100) { nodes { id text senderId receiverId timestamp sender { id name } receiver { id name } } } conversation(userA: "1", userB: "2", first: 100) { nodes { id text sender { id name } } } }`, "too complex"},
+		{`{ thread(id: "x") { sender { id } } }`, ""},
+
+		// Fields of the same response key are merged, or rejected if they differ
+		{`{ user(id: "1") { id } user(id: "1") { name } }`, ""},
+		{`{ user(id: "1") { id } user(id: "2") { id } }`, "Query.user is selected as user with different arguments"},
+		{`{ user(id: "1") { id } user { id } }`, "argument id of field Query.user is required"},
+		{`{ u: user(id: "1") { id } u: me { id } }`, "user and me are both selected as u on Query"},
+		{`{ me { x: id x: name } }`, "id and name are both selected as x on User"},
+		{`{ me { id } ...F } fragment F on Query { me: user(id: "1") { id } }`, "me and user are both selected as me on Query"},
+		{`{ a: user(id: "1") { id } b: user(id: "2") { id } }`, ""},
+		{`{ thread(id: "x") { sender { n: name } } thread(id: "x") { sender { n: id } } }`, "name and id are both selected as n on User"},
+		{`query ($id: ID!) { user(id: $id) { id } user(id: $id) { name } }`, ""},
+	}
+	for _, tt := range tests {
+		_, err := graphQLSchema.prepare(&gqlContext{cs: cs}, tt.query, "", map[string]interface{}{"id": "1"})
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.query, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: no error, want %q", tt.query, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: error %q, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+	query := `{ thread(id: "x") { sender { id } } }`
+	if _, err := graphQLSchema.prepare(&gqlContext{cs: cs}, query, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A schema nesting one object inside itself lets queries go arbitrarily deep
+	node := &gqlObject{Name: "Node", Fields: map[string]*gqlField{"id": gqlProp("ID!", "", func(interface{}) interface{} { return "1" })}}
+	node.Fields["child"] = &gqlField{Type: "Node", Object: node}
+	schema := newGQLSchema(&gqlObject{Name: "Query", Fields: map[string]*gqlField{"node": {Type: "Node", Object: node}}}, nil, nil)
+
+	deep := `{ node { id } }`
+	for i := 2; i < gqlMaxDepth; i++ {
+		deep = strings.Replace(deep, "{ id }", "{ child { id } }", 1)
+	}
+	if _, err := schema.prepare(&gqlContext{}, deep, "", nil); err != nil {
+		t.Fatalf("%d levels: %v", gqlMaxDepth, err)
+	}
+	deep = strings.Replace(deep, "{ id }", "{ child { id } }", 1)
+	if _, err := schema.prepare(&gqlContext{}, deep, "", nil); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Fatalf("%d levels: got %v", gqlMaxDepth+1, err)
+	}
+}
+
+func TestGraphQLExecute(t *testing.T) {
+	cs, rootID := newGraphQLTestService(t)
+	alice := gqlClaims("alice", "user")
+
+	tests := []struct {
+		query string
+		vars  map[string]interface{}
+		want  string
+	}{
+		{`{ me { id name } }`, nil, `{"me":{"id":"1","name":"alice"}}`},
+		{`query ($id: ID!) { u: user(id: $id) { name } }`, map[string]interface{}{"id": "2"}, `{"u":{"name":"bob"}}`},
+		{`{ user(id: "404") { name } }`, nil, `{"user":null}`},
+		{`{ me { __typename ...F } } fragment F on User { name }`, nil, `{"me":{"__typename":"User","name":"alice"}}`},
+		{`{ me { id @skip(if: true) name @include(if: false) version } }`, nil, `{"me":{"version":1}}`},
+		{`query ($skip: Boolean!) { me { id @skip(if: $skip) } }`, map[string]interface{}{"skip": true}, `{"me":{}}`},
+		{`{ users(first: 2, sort: "name") { totalCount nodes { name } pageInfo { hasNextPage } } }`, nil,
+			`{"users":{"nodes":[{"name":"alice"},{"name":"bob"}],"pageInfo":{"hasNextPage":true},"totalCount":3}}`},
+
+		// Repeated fields are merged: both selections of sender come out
+		{`{ messages(userId: "1") { nodes { sender { id } sender { name } text } } }`, nil,
+			`{"messages":{"nodes":[{"sender":{"id":"2","name":"bob"},"text":"hello"}]}}`},
+		{`{ messages(userId: "1") { nodes { ... on Message { sender { id } } sender { name } } } }`, nil,
+			`{"messages":{"nodes":[{"sender":{"id":"2","name":"bob"}}]}}`},
+		{`{ me { id } me { name } ...F } fragment F on Query { me { version } }`, nil, `{"me":{"id":"1","name":"alice","version":1}}`},
+		{`{ thread(id: "` + rootID + `") { text replyCount } }`, nil, `{"thread":[{"replyCount":1,"text":"hi"},{"replyCount":0,"text":"hello"}]}`},
+	}
+	for _, tt := range tests {
+		resp := runGraphQL(t, cs, alice, tt.query, tt.vars)
+		if len(resp.Errors) > 0 {
+			t.Errorf("%s: errors %v", tt.query, resp.Errors)
+		}
+		if got := gqlJSON(t, resp); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGraphQLFieldErrors(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+	resp := runGraphQL(t, cs, nil, `{ me { id } user(id: "1") { name } }`, nil)
+	if got, want := gqlJSON(t, resp), `{"me":null,"user":{"name":"alice"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Path[0] != "me" {
+		t.Errorf("errors %v, want one for me", resp.Errors)
+	}
+}
+
+func TestGraphQLMutation(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+	resp := runGraphQL(t, cs, gqlClaims("alice", "user"),
+		`mutation { sendMessage(senderId: "1", receiverId: "3", text: "hey") { status message { text receiver { name } } } }`, nil)
+	if len(resp.Errors) > 0 {
+		t.Fatal(resp.Errors)
+	}
+	if got, want := gqlJSON(t, resp), `{"sendMessage":{"message":{"receiver":{"name":"carol"},"text":"hey"},"status":"DELIVERED"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(cs.GetConversation("1", "3")) != 1 {
+		t.Error("the message was not stored")
+	}
+
+	resp = runGraphQL(t, cs, gqlClaims("alice", "user"), `mutation { sendMessage(senderId: "2", receiverId: "3", text: "not bob") { status } }`, nil)
+	if len(resp.Errors) != 1 || len(cs.GetConversation("2", "3")) != 0 {
+		t.Errorf("alice sent as bob: errors %v", resp.Errors)
+	}
+}
+
+// TestGraphQLReadAuth checks that only the participants and admins read messages
+func TestGraphQLReadAuth(t *testing.T) {
+	cs, rootID := newGraphQLTestService(t)
+	queries := map[string]string{
+		"messages":     `{ messages(userId: "2") { totalCount } }`,
+		"conversation": `{ conversation(userA: "1", userB: "2") { totalCount } }`,
+		"thread":       `{ thread(id: "` + rootID + `") { id } }`,
+	}
+	tests := []struct {
+		name, role string
+		allowed    map[string]bool
+	}{
+		{"", "", nil},
+		{"alice", "user", map[string]bool{"conversation": true, "thread": true}},
+		{"bob", "user", map[string]bool{"messages": true, "conversation": true, "thread": true}},
+		{"carol", "user", nil},
+		{"carol", "admin", map[string]bool{"messages": true, "conversation": true, "thread": true}},
+	}
+	for _, tt := range tests {
+		for field, query := range queries {
+			resp := runGraphQL(t, cs, gqlClaims(tt.name, tt.role), query, nil)
+			if denied := len(resp.Errors) > 0; denied == tt.allowed[field] {
+				t.Errorf("%s as %q (%s): errors %v", field, tt.name, tt.role, resp.Errors)
+			}
+		}
+	}
+}
+
+// TestGraphQLSubscriptionAuth checks that messageAdded is refused to other users
+func TestGraphQLSubscriptionAuth(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"alice", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		body := `{"query": "subscription { messageAdded(userId: \"2\") { id } }"}`
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+		if tt.name != "" {
+			token, err := GenerateJWT(tt.name, "user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", token)
+		}
+		rec := httptest.NewRecorder()
+		cs.GraphQLHandler(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("as %q: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+
+	resp := runGraphQL(t, cs, nil, `{ __schema { queryType { name } mutationType { name } subscriptionType { name } } }`, nil)
+	if got, want := gqlJSON(t, resp), `{"__schema":{"mutationType":{"name":"Mutation"},"queryType":{"name":"Query"},"subscriptionType":{"name":"Subscription"}}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	resp = runGraphQL(t, cs, nil, `{ __type(name: "Message") { kind fields { name type { kind name ofType { kind name } } } } }`, nil)
+	var message struct {
+		Type struct {
+			Kind   string
+			Fields []struct {
+				Name string
+				Type struct {
+					Kind   string
+					Name   *string
+					OfType *struct{ Kind, Name string }
+				}
+			}
+		} `json:"__type"`
+	}
+	if err := json.Unmarshal([]byte(gqlJSON(t, resp)), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Type.Kind != "OBJECT" || len(message.Type.Fields) != len(graphQLSchema.types["Message"].Object.Fields) {
+		t.Fatalf("got %+v", message.Type)
+	}
+	for _, f := range message.Type.Fields {
+		switch f.Name {
+		case "id":
+			if f.Type.Kind != "NON_NULL" || f.Type.OfType == nil || f.Type.OfType.Name != "ID" {
+				t.Errorf("id has type %+v, want ID!", f.Type)
+			}
+		case "sender":
+			if f.Type.Kind != "OBJECT" || f.Type.Name == nil || *f.Type.Name != "User" {
+				t.Errorf("sender has type %+v, want User", f.Type)
+			}
+		}
+	}
+
+	resp = runGraphQL(t, cs, nil, `{ __type(name: "Nope") { name } }`, nil)
+	if got := gqlJSON(t, resp); got != `{"__type":null}` {
+		t.Errorf("unknown type: got %s", got)
+	}
+}
+
+// gqlIntrospectionQuery is the query GraphiQL loads the schema with
+const gqlIntrospectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives { name description locations args { ...InputValue } }
+  }
+}
+fragment FullType on __Type {
+  kind name description
+  fields(includeDeprecated: true) {
+    name description
+    args { ...InputValue }
+    type { ...TypeRef }
+    isDeprecated deprecationReason
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name description isDeprecated deprecationReason }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue {
+  name description
+  type { ...TypeRef }
+  defaultValue
+}
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name
+    ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } } }
+}`
+
+func TestGraphQLIntrospectionQuery(t *testing.T) {
+	cs, _ := newGraphQLTestService(t)
+	resp := runGraphQL(t, cs, nil, gqlIntrospectionQuery, nil)
+	if len(resp.Errors) > 0 {
+		t.Fatal(resp.Errors)
+	}
+
+	var result struct {
+		Schema struct {
+			Types []struct {
+				Kind, Name string
+				Fields     []struct{ Name string }
+			}
+			Directives []struct{ Name string }
+		} `json:"__schema"`
+	}
+	if err := json.Unmarshal([]byte(gqlJSON(t, resp)), &result); err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]string)
+	for _, typ := range result.Schema.Types {
+		kinds[typ.Name] = typ.Kind
+		for _, f := range typ.Fields {
+			if strings.HasPrefix(f.Name, "__") {
+				t.Errorf("%s lists the introspection field %s", typ.Name, f.Name)
+			}
+		}
+	}
+	for name, kind := range map[string]string{
+		"Query": "OBJECT", "Message": "OBJECT", "MessageConnection": "OBJECT", "__Type": "OBJECT",
+		"ID": "SCALAR", "String": "SCALAR", "Int": "SCALAR", "Boolean": "SCALAR", "__TypeKind": "ENUM",
+	} {
+		if kinds[name] != kind {
+			t.Errorf("type %s has kind %q, want %s", name, kinds[name], kind)
+		}
+	}
+	if len(result.Schema.Directives) != 2 {
+		t.Errorf("directives %v, want include and skip", result.Schema.Directives)
+	}
+}
+
+func TestGraphQLSDL(t *testing.T) {
+	sdl := graphQLSchema.SDL()
+	for _, want := range []string{"query: Query", "type Message {", "thread(id: ID!): [Message!]"} {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("SDL lacks %q", want)
+		}
+	}
+	if strings.Contains(sdl, "__") {
+		t.Error("SDL lists introspection types or fields")
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JakubSchwenkbeck/go-web-server/proto/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcAuth is the authentication each method requires, using the levels of the
+// OpenAPI document. Methods not listed here are open to everyone.
+var grpcAuth = map[string]string{
+	chatpb.UserService_CreateUser_FullMethodName: authAdmin,
+	chatpb.UserService_UpdateUser_FullMethodName: authSelf, // Checked against the user in ReplaceUser
+	chatpb.UserService_DeleteUser_FullMethodName: authAdmin,
+
+	// Checked against the participants in the handlers, like in the HTTP API
+	chatpb.ChatService_SendMessage_FullMethodName:     authJWT,
+	chatpb.ChatService_ListMessages_FullMethodName:    authJWT,
+	chatpb.ChatService_GetConversation_FullMethodName: authJWT,
+	chatpb.ChatService_GetThread_FullMethodName:       authJWT,
+	chatpb.ChatService_Subscribe_FullMethodName:       authJWT,
+}
+
+// claimsKey is the context key of the JWT claims of a gRPC call
+type claimsKey struct{}
+
+// grpcClaims returns the claims the interceptors found for the call, or nil
+func grpcClaims(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// grpcAuthenticate reads the JWT from the "authorization" metadata of the call and
+// checks it against the level the method requires. A missing token is fine for
+// open methods; an invalid one is rejected everywhere, like in the HTTP API.
+func grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = values[0]
+		}
+	}
+
+	level := grpcAuth[method]
+	if token == "" {
+		if level != "" && level != authNone {
+			return ctx, status.Error(codes.Unauthenticated, "A valid JWT is required in the authorization metadata")
+		}
+		return ctx, nil
+	}
+	claims, err := ParseClaims(token)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "Invalid token: "+err.Error())
+	}
+	if level == authAdmin && claims.Role != "admin" {
+		return ctx, status.Error(codes.PermissionDenied, "Only admins may call "+method)
+	}
+	return context.WithValue(ctx, claimsKey{}, claims), nil
+}
+
+// grpcUnaryAuth authenticates unary calls
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// grpcStreamAuth authenticates streaming calls
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream is a server stream carrying the context with the caller's claims
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context implements grpc.ServerStream
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcError turns a problem of the shared user and chat logic into a gRPC status
+// with the code matching its HTTP status. Other errors become Internal.
+func grpcError(err error) error {
+	var problem *Problem
+	if !errors.As(err, &problem) {
+		fmt.Println("gRPC call failed:", err)
+		return status.Error(codes.Internal, "Internal error")
+	}
+
+	code := codes.Internal
+	switch problem.Status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	}
+
+	message := problem.Error()
+	for _, fe := range problem.Errors {
+		message += "; " + fe.Field + " " + fe.Message
+	}
+	return status.Error(code, message)
+}
+
+// grpcUser converts a user to its protobuf message
+func grpcUser(user User) *chatpb.User {
+	return &chatpb.User{
+		Id:        user.ID,
+		Name:      user.Name,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		Version:   int32(user.Version),
+	}
+}
+
+// grpcMessage converts a message to its protobuf message
+func grpcMessage(msg Message) *chatpb.Message {
+	return &chatpb.Message{
+		Id:         msg.ID,
+		SenderId:   msg.SenderID,
+		ReceiverId: msg.ReceiverID,
+		Text:       msg.Message,
+		Timestamp:  timestamppb.New(msg.TimeStamp),
+		ReplyTo:    msg.ReplyTo,
+		ReplyCount: int32(msg.ReplyCount),
+		PollId:     msg.PollID,
+		Encrypted:  msg.IsEncrypted(),
+	}
+}
+
+// grpcMessages converts a list of messages, filling in their reply counts
+func (cs *ChatService) grpcMessages(msgs []Message) *chatpb.ListMessagesResponse {
+	resp := &chatpb.ListMessagesResponse{Messages: make([]*chatpb.Message, 0, len(msgs))}
+	for _, msg := range cs.withReplyCounts(msgs) {
+		resp.Messages = append(resp.Messages, grpcMessage(msg))
+	}
+	return resp
+}
+
+// grpcUserService implements chatpb.UserServiceServer on top of userRepo
+type grpcUserService struct {
+	chatpb.UnimplementedUserServiceServer
+}
+
+// ListUsers implements chatpb.UserServiceServer with the filters of GetUsers
+func (grpcUserService) ListUsers(ctx context.Context, req *chatpb.ListUsersRequest) (*chatpb.ListUsersResponse, error) {
+	values := url.Values{}
+	for param, value := range map[string]string{"id": req.Id, "name": req.Name, "q": req.Search, "sort": req.Sort, "cursor": req.PageToken} {
+		if value != "" {
+			values.Set(param, value)
+		}
+	}
+	if req.PageSize != 0 {
+		values.Set("limit", strconv.Itoa(int(req.PageSize)))
+	}
+	query, err := ParseUserQuery(values)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	stored, err := userRepo.List()
+	if err != nil {
+		return nil, grpcError(repoProblem(err))
+	}
+	all := make([]User, 0, len(stored))
+	for _, user := range stored {
+		all = append(all, user.InternData)
+	}
+
+	page, total, next := query.Apply(all)
+	resp := &chatpb.ListUsersResponse{TotalCount: int32(total), NextPageToken: next}
+	for _, user := range page {
+		resp.Users = append(resp.Users, grpcUser(user))
+	}
+	return resp, nil
+}
+
+// GetUser implements chatpb.UserServiceServer
+func (grpcUserService) GetUser(ctx context.Context, req *chatpb.GetUserRequest) (*chatpb.User, error) {
+	stored, err := userRepo.Get(req.Id)
+	if err != nil {
+		return nil, grpcError(repoProblem(err))
+	}
+	return grpcUser(stored.InternData), nil
+}
+
+// CreateUser implements chatpb.UserServiceServer like the CreateUser handler
+func (grpcUserService) CreateUser(ctx context.Context, req *chatpb.CreateUserRequest) (*chatpb.User, error) {
+	user := User{ID: NewID(), Name: req.Name}
+	if errs := Validate(user); errs != nil {
+		return nil, grpcError(ValidationProblem(errs))
+	}
+
+	user.Name = strings.TrimSpace(user.Name)
+	user.CreatedAt = time.Now()
+	user.Version = 1
+	if err := userRepo.Create(ChatUser{InternData: user, Role: "user"}); err != nil {
+		return nil, grpcError(repoProblem(err))
+	}
+	return grpcUser(user), nil
+}
+
+// UpdateUser implements chatpb.UserServiceServer
+func (grpcUserService) UpdateUser(ctx context.Context, req *chatpb.UpdateUserRequest) (*chatpb.User, error) {
+	if req.User == nil {
+		return nil, status.Error(codes.InvalidArgument, "user is required")
+	}
+	user, err := ReplaceUser(grpcClaims(ctx), User{ID: req.User.Id, Name: req.User.Name, Version: int(req.User.Version)})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcUser(user), nil
+}
+
+// DeleteUser implements chatpb.UserServiceServer, the version takes the place of If-Match
+func (grpcUserService) DeleteUser(ctx context.Context, req *chatpb.DeleteUserRequest) (*emptypb.Empty, error) {
+	stored, err := userRepo.Get(req.Id)
+	if err != nil {
+		return nil, grpcError(repoProblem(err))
+	}
+	if int(req.Version) != stored.InternData.Version {
+		return nil, grpcError(repoProblem(ErrVersionConflict))
+	}
+	if err := userRepo.Delete(req.Id); err != nil {
+		return nil, grpcError(repoProblem(err))
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// grpcChatService implements chatpb.ChatServiceServer on top of a ChatService
+type grpcChatService struct {
+	chatpb.UnimplementedChatServiceServer
+	cs *ChatService
+}
+
+// SendMessage implements chatpb.ChatServiceServer
+func (s grpcChatService) SendMessage(ctx context.Context, req *chatpb.SendMessageRequest) (*chatpb.SendMessageResponse, error) {
+	claims := grpcClaims(ctx)
+	senderID, p := s.cs.senderFor(claims, req.SenderId)
+	if p != nil {
+		return nil, grpcError(p)
+	}
+	msg := Message{SenderID: senderID, ReceiverID: req.ReceiverId, Message: req.Text, ReplyTo: req.ReplyTo}
+	stored, err := s.cs.SendChecked(msg, claims.Role)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if stored == nil {
+		return &chatpb.SendMessageResponse{HeldForReview: true}, nil
+	}
+	return &chatpb.SendMessageResponse{Message: grpcMessage(*stored)}, nil
+}
+
+// ListMessages implements chatpb.ChatServiceServer
+func (s grpcChatService) ListMessages(ctx context.Context, req *chatpb.ListMessagesRequest) (*chatpb.ListMessagesResponse, error) {
+	if p := s.cs.participantProblem(grpcClaims(ctx), req.UserId); p != nil {
+		return nil, grpcError(p)
+	}
+	return s.cs.grpcMessages(s.cs.GetMessagesForUser(req.UserId)), nil
+}
+
+// GetConversation implements chatpb.ChatServiceServer
+func (s grpcChatService) GetConversation(ctx context.Context, req *chatpb.GetConversationRequest) (*chatpb.ListMessagesResponse, error) {
+	if req.UserA == "" || req.UserB == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_a and user_b are required")
+	}
+	if p := s.cs.participantProblem(grpcClaims(ctx), req.UserA, req.UserB); p != nil {
+		return nil, grpcError(p)
+	}
+	return s.cs.grpcMessages(s.cs.GetConversation(req.UserA, req.UserB)), nil
+}
+
+// GetThread implements chatpb.ChatServiceServer
+func (s grpcChatService) GetThread(ctx context.Context, req *chatpb.GetThreadRequest) (*chatpb.ListMessagesResponse, error) {
+	thread, ok := s.cs.GetThread(req.Id)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Message not found")
+	}
+	if p := s.cs.participantProblem(grpcClaims(ctx), thread[0].SenderID, thread[0].ReceiverID); p != nil {
+		return nil, grpcError(p)
+	}
+	return s.cs.grpcMessages(thread), nil
+}
+
+// Subscribe implements chatpb.ChatServiceServer. It streams until the client cancels.
+func (s grpcChatService) Subscribe(req *chatpb.SubscribeRequest, stream grpc.ServerStreamingServer[chatpb.Message]) error {
+	if req.UserId == "" {
+		return status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if p := s.cs.participantProblem(grpcClaims(stream.Context()), req.UserId); p != nil {
+		return grpcError(p)
+	}
+	events, cancel := s.cs.broker.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			msg := event.Message
+			if event.Kind != EventMessage || (msg.SenderID != req.UserId && msg.ReceiverID != req.UserId) {
+				continue
+			}
+			if err := stream.Send(grpcMessage(msg)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewGRPCServer creates the gRPC server with the user and chat services of cs and
+// the standard health service reporting both of them
+func NewGRPCServer(cs *ChatService) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryAuth),
+		grpc.ChainStreamInterceptor(grpcStreamAuth),
+	)
+	chatpb.RegisterUserServiceServer(server, grpcUserService{})
+	chatpb.RegisterChatServiceServer(server, grpcChatService{cs: cs})
+
+	healthServer := health.NewServer()
+	for _, service := range []string{"", chatpb.UserService_ServiceDesc.ServiceName, chatpb.ChatService_ServiceDesc.ServiceName} {
+		healthServer.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(server, healthServer)
+	return server
+}
+
+// ServeGRPC serves the gRPC API of cs on addr until it fails
+func ServeGRPC(cs *ChatService, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return NewGRPCServer(cs).Serve(lis)
+}
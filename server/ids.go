@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// crockford is the Base32 alphabet of ULIDs, it leaves out I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idPattern is the mux pattern for IDs in paths. It matches the ULIDs the server
+// assigns as well as the numeric IDs handed out before and fixed IDs like the one
+// of the built-in bot, so those stay resolvable.
+const idPattern = "[0-9A-Za-z]+"
+
+// ulidSource hands out ULIDs. Within the same millisecond the random part is
+// incremented instead of drawn again, so IDs of one instance are strictly increasing.
+// If it overflows, the time part moves on to the next millisecond.
+type ulidSource struct {
+	mu     sync.Mutex
+	lastMS uint64
+	random [10]byte
+}
+
+// ids is the source of every server assigned ID
+var ids = &ulidSource{}
+
+// NewID returns a new ULID: 48 bits of milliseconds since the Unix epoch followed by
+// 80 random bits, encoded as 26 Crockford Base32 characters. IDs sort by creation
+// time as plain strings and are unique across instances.
+func NewID() string {
+	return ids.next(time.Now())
+}
+
+// next returns the ULID for now
+func (s *ulidSource) next(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms > s.lastMS {
+		s.lastMS = ms
+		rand.Read(s.random[:])
+	} else if !s.increment() {
+		// The random part wrapped around to zero, continue in the next millisecond
+		s.lastMS++
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint16(b[0:2], uint16(s.lastMS>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(s.lastMS))
+	copy(b[6:], s.random[:])
+	return encodeULID(b)
+}
+
+// increment adds one to the random part, returning false if it overflowed
+func (s *ulidSource) increment() bool {
+	for i := len(s.random) - 1; i >= 0; i-- {
+		s.random[i]++
+		if s.random[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes 128 bits as 26 Base32 characters, the first one holds only 3 bits
+func encodeULID(b [16]byte) string {
+	out := make([]byte, 26)
+	for i := range out {
+		var v byte
+		for j := 0; j < 5; j++ {
+			v <<= 1
+			bit := i*5 + j - 2
+			if bit >= 0 && b[bit/8]>>(7-bit%8)&1 == 1 {
+				v |= 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Media types of the two PATCH formats
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// MergePatch applies an RFC 7396 JSON Merge Patch to the JSON document doc
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(target, p))
+}
+
+// mergeValue merges patch into target: objects are merged member by member,
+// null removes a member and anything else replaces the target.
+func mergeValue(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergeValue(t[key], value)
+		}
+	}
+	return t
+}
+
+// PatchOperation is one operation of an RFC 6902 JSON Patch.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch applies an RFC 6902 JSON Patch to the JSON document doc.
+// The patch is applied as a whole: if one operation fails, doc is left as it was.
+func JSONPatch(doc, patch []byte) ([]byte, error) {
+	var ops []PatchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		var err error
+		if target, err = applyOperation(target, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+// applyOperation applies a single JSON Patch operation and returns the new document
+func applyOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		// The root can't be removed, replacing it just swaps the whole document
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = removeValue(doc, path); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, errors.New("can't move a value into itself")
+			}
+			if doc, err = removeValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			value = deepCopy(value)
+		}
+		return addValue(doc, path, value)
+	case "test":
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, errors.New("unknown operation " + op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("path " + pointer + " must start with /")
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; "-" is only allowed when appending
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if token == "-" && appending {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errors.New("invalid array index " + token)
+	}
+	limit := length - 1
+	if appending {
+		limit = length
+	}
+	if i > limit {
+		return 0, errors.New("array index " + token + " out of range")
+	}
+	return i, nil
+}
+
+// getValue returns the value at path
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.New("member " + token + " does not exist")
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errors.New("can't look up " + token + " in a scalar value")
+		}
+	}
+	return doc, nil
+}
+
+// updateAt changes the container holding the last token of path with change and
+// returns the new document. Containers on the way are replaced as needed.
+func updateAt(doc interface{}, path []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+
+	token := path[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, errors.New("member " + token + " does not exist")
+		}
+		child, err := updateAt(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := updateAt(node[i], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, errors.New("can't look up " + token + " in a scalar value")
+}
+
+// addValue adds value at path, replacing the whole document for the empty path
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateAt(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, errors.New("can't add " + token + " to a scalar value")
+	})
+}
+
+// removeValue removes the value at path, which must exist
+func removeValue(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+	return updateAt(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, errors.New("member " + token + " does not exist")
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, errors.New("can't remove " + token + " from a scalar value")
+	})
+}
+
+// deepCopy copies a decoded JSON value, so copies don't share maps or slices
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			c[key] = deepCopy(item)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, item := range v {
+			c[i] = deepCopy(item)
+		}
+		return c
+	}
+	return value
+}
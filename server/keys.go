@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// KeyDirectory stores the public keys users publish for their devices, so that
+// senders can encrypt messages for every device of a recipient.
+type KeyDirectory struct {
+	mu   sync.Mutex
+	keys map[string]map[string]DeviceKey // User ID -> device ID -> current key
+}
+
+// NewKeyDirectory creates an empty KeyDirectory
+func NewKeyDirectory() *KeyDirectory {
+	return &KeyDirectory{keys: make(map[string]map[string]DeviceKey)}
+}
+
+// keyDirectory is the directory shared by the chat endpoints
+var keyDirectory = NewKeyDirectory()
+
+// Publish stores the public key of a device. Publishing again for the same
+// device rotates the key: the old key is replaced and the version goes up.
+func (d *KeyDirectory) Publish(userID, deviceID, algorithm string, publicKey []byte) DeviceKey {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	devices, ok := d.keys[userID]
+	if !ok {
+		devices = make(map[string]DeviceKey)
+		d.keys[userID] = devices
+	}
+
+	key := DeviceKey{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		Algorithm: algorithm,
+		PublicKey: publicKey,
+		Version:   devices[deviceID].Version + 1,
+		CreatedAt: time.Now(),
+	}
+	devices[deviceID] = key
+	return key
+}
+
+// Revoke removes the key of a device. Returns false if there was none.
+func (d *KeyDirectory) Revoke(userID, deviceID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.keys[userID][deviceID]; !ok {
+		return false
+	}
+	delete(d.keys[userID], deviceID)
+	return true
+}
+
+// Lookup returns the current keys of all devices of a user, sorted by device ID
+func (d *KeyDirectory) Lookup(userID string) []DeviceKey {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]DeviceKey, 0, len(d.keys[userID]))
+	for _, key := range d.keys[userID] {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].DeviceID < keys[j].DeviceID })
+	return keys
+}
+
+// Limits of encrypted messages. The server can't read them, so maxMessageLength
+// doesn't apply and the size of the ciphertext is limited instead.
+const (
+	maxCiphertextBytes = 64 << 10 // Largest ciphertext of a message
+	maxEnvelopes       = 32       // Most key envelopes per message, one per device
+)
+
+// envelopeSizeErrors returns the field errors of a message whose ciphertext or
+// envelopes exceed the limits, or which has envelopes without ciphertext.
+func envelopeSizeErrors(msg Message) []FieldError {
+	var errs []FieldError
+	if len(msg.Ciphertext) > maxCiphertextBytes {
+		errs = append(errs, FieldError{Field: "Ciphertext", Message: "must be at most " + strconv.Itoa(maxCiphertextBytes) + " bytes"})
+	}
+	if len(msg.Envelopes) > maxEnvelopes {
+		errs = append(errs, FieldError{Field: "Envelopes", Message: "must have at most " + strconv.Itoa(maxEnvelopes) + " items"})
+	}
+	if len(msg.Envelopes) > 0 && !msg.IsEncrypted() {
+		errs = append(errs, FieldError{Field: "Envelopes", Message: "must be empty without Ciphertext"})
+	}
+	return errs
+}
+
+// ValidateEnvelopes checks that an encrypted message has no plaintext, has an
+// envelope for the receiver and that every envelope targets a device with a
+// published key.
+func (d *KeyDirectory) ValidateEnvelopes(msg Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if msg.Message != "" {
+		return errors.New("encrypted messages must not carry plaintext content")
+	}
+
+	forReceiver := false
+	for _, env := range msg.Envelopes {
+		if len(env.WrappedKey) == 0 {
+			return errors.New("envelope for device " + env.DeviceID + " has no wrapped key")
+		}
+		if _, ok := d.keys[env.RecipientID][env.DeviceID]; !ok {
+			return errors.New("no public key published for device " + env.DeviceID + " of user " + env.RecipientID)
+		}
+		if env.RecipientID == msg.ReceiverID {
+			forReceiver = true
+		}
+	}
+	if !forReceiver {
+		return errors.New("encrypted message has no key envelope for the receiver")
+	}
+	return nil
+}
+
+// HTTP Handlers
+
+// isSelf reports whether the request carries a JWT of the user with the given ID
+func (cs *ChatService) isSelf(r *http.Request, userID string) bool {
+	claims, err := ClaimsFromRequest(r)
+	if err != nil {
+		return false
+	}
+
+	id, ok := cs.UserIDByName(claims.Username)
+	return ok && id == userID
+}
+
+// callerID returns the ID of the user whose JWT the request carries. If there is
+// no such user it answers the request itself and ok is false.
+func (cs *ChatService) callerID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	claims, err := ClaimsFromRequest(r)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "A valid JWT is required in the Authorization header"))
+		return "", false
+	}
+
+	userID, found := cs.UserIDByName(claims.Username)
+	if !found {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "User not found"))
+		return "", false
+	}
+	return userID, true
+}
+
+// GetKeysHandler returns the current device keys of a user
+func GetKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyDirectory.Lookup(userID))
+}
+
+// PublishKeyHandler publishes or rotates the public key of one of the caller's devices
+func (cs *ChatService) PublishKeyHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !cs.isSelf(r, params["id"]) {
+		WriteProblem(w, r, NewProblem(http.StatusForbidden, "Users can only publish their own keys"))
+		return
+	}
+
+	var req struct {
+		Algorithm string
+		PublicKey []byte
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if req.Algorithm == "" || len(req.PublicKey) == 0 {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "Algorithm and PublicKey are required"))
+		return
+	}
+
+	key := keyDirectory.Publish(params["id"], params["device"], req.Algorithm, req.PublicKey)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// RevokeKeyHandler removes the key of one of the caller's devices
+func (cs *ChatService) RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !cs.isSelf(r, params["id"]) {
+		WriteProblem(w, r, NewProblem(http.StatusForbidden, "Users can only revoke their own keys"))
+		return
+	}
+
+	if !keyDirectory.Revoke(params["id"], params["device"]) {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Key not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LinkPreview is the metadata shown for a link in a message.
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string `json:",omitempty"`
+	Image       string `json:",omitempty"`
+	SiteName    string `json:",omitempty"`
+}
+
+const (
+	previewTimeout      = 5 * time.Second  // Total time allowed for fetching one page
+	previewMaxBytes     = 512 * 1024       // Only the start of a page is read, the metadata lives in the head
+	previewMaxLinks     = 3                // Links per message that get a preview
+	previewTTL          = time.Hour        // How long a fetched preview is cached
+	previewFailureTTL   = 10 * time.Minute // How long a failed fetch is remembered
+	previewCacheEntries = 10000            // Upper bound for the cache size
+)
+
+// previewEntry is a cached preview; a nil preview marks a failed fetch
+type previewEntry struct {
+	preview *LinkPreview
+	expires time.Time
+}
+
+// LinkPreviewer fetches previews for links in messages in the background and
+// caches them, so messages can be returned with their previews attached.
+type LinkPreviewer struct {
+	client *http.Client
+
+	mu       sync.Mutex
+	cache    map[string]previewEntry
+	inFlight map[string]bool
+}
+
+// NewLinkPreviewer creates a LinkPreviewer whose HTTP client refuses to connect
+// to private, loopback and other internal addresses.
+func NewLinkPreviewer() *LinkPreviewer {
+	dialer := &net.Dialer{
+		Timeout: previewTimeout,
+		// Control runs after DNS resolution, so a public name that resolves to
+		// an internal address is caught as well.
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+				return errors.New("link preview: refusing to connect to " + host)
+			}
+			return nil
+		},
+	}
+
+	return &LinkPreviewer{
+		client: &http.Client{
+			Timeout: previewTimeout,
+			Transport: &http.Transport{
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   previewTimeout,
+				ResponseHeaderTimeout: previewTimeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("link preview: too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return errors.New("link preview: redirect to unsupported scheme")
+				}
+				return nil
+			},
+		},
+		cache:    make(map[string]previewEntry),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// linkPreviews is the previewer used for all chat messages
+var linkPreviews = NewLinkPreviewer()
+
+// reservedNets are ranges that the net.IP checks don't cover but that never host
+// public web sites, or that lead into the local network
+var reservedNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, may translate to internal IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+}
+
+// isInternalIP reports whether ip must never be fetched from (SSRF blocklist)
+func isInternalIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range reservedNets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// previewLinks returns the http(s) links of a message that get a preview
+func previewLinks(text string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, link := range urlPattern.FindAllString(text, -1) {
+		link = strings.TrimRight(link, ".,;:!?)")
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == previewMaxLinks {
+			break
+		}
+	}
+	return links
+}
+
+// Prefetch starts fetching previews for the links in msg that aren't cached yet.
+// It returns right away.
+func (p *LinkPreviewer) Prefetch(msg Message) {
+	if msg.IsEncrypted() {
+		return
+	}
+
+	for _, link := range previewLinks(msg.Message) {
+		p.mu.Lock()
+		entry, cached := p.cache[link]
+		fresh := cached && time.Now().Before(entry.expires)
+		start := !fresh && !p.inFlight[link]
+		if start {
+			p.inFlight[link] = true
+		}
+		p.mu.Unlock()
+
+		if start {
+			go p.fetchAndStore(link)
+		}
+	}
+}
+
+// fetchAndStore fetches a preview and puts the result into the cache
+func (p *LinkPreviewer) fetchAndStore(link string) {
+	preview, err := p.fetch(link)
+	entry := previewEntry{preview: preview, expires: time.Now().Add(previewTTL)}
+	if err != nil {
+		fmt.Println("Link preview failed:", err)
+		entry = previewEntry{expires: time.Now().Add(previewFailureTTL)}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inFlight, link)
+	if len(p.cache) >= previewCacheEntries {
+		now := time.Now()
+		for key, e := range p.cache {
+			if now.After(e.expires) {
+				delete(p.cache, key)
+			}
+		}
+		if len(p.cache) >= previewCacheEntries {
+			return
+		}
+	}
+	p.cache[link] = entry
+}
+
+// fetch downloads the start of a page and extracts its preview metadata
+func (p *LinkPreviewer) fetch(link string) (*LinkPreview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "go-web-server link preview")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("link preview: %s answered %s", link, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "text/html") {
+		return nil, fmt.Errorf("link preview: %s is %s, not HTML", link, ct)
+	}
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, previewMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return parsePreview(link, string(page)), nil
+}
+
+var (
+	metaTagPattern   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attributePattern = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	titlePattern     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// parsePreview extracts OpenGraph metadata from a page, falling back to the
+// title tag and the description meta tag.
+func parsePreview(link, page string) *LinkPreview {
+	meta := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attributePattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = strings.Trim(m[2], `"'`)
+		}
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		if key != "" && attrs["content"] != "" {
+			meta[strings.ToLower(key)] = html.UnescapeString(attrs["content"])
+		}
+	}
+
+	preview := &LinkPreview{
+		URL:         link,
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+		Image:       meta["og:image"],
+		SiteName:    meta["og:site_name"],
+	}
+	if preview.Title == "" {
+		if m := titlePattern.FindStringSubmatch(page); m != nil {
+			preview.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+		}
+	}
+	if preview.Description == "" {
+		preview.Description = meta["description"]
+	}
+	return preview
+}
+
+// Attach fills in the previews that are already cached for each message
+func (p *LinkPreviewer) Attach(msgs []Message) []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for i := range msgs {
+		if msgs[i].IsEncrypted() {
+			continue
+		}
+		msgs[i].Previews = nil
+		for _, link := range previewLinks(msgs[i].Message) {
+			if entry, ok := p.cache[link]; ok && entry.preview != nil && now.Before(entry.expires) {
+				msgs[i].Previews = append(msgs[i].Previews, *entry.preview)
+			}
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// FilterAction is the verdict a MessageFilter reaches about a message.
+// Actions are ordered by severity, so the pipeline can keep the strongest one.
+type FilterAction int
+
+const (
+	FilterAllow  FilterAction = iota // Deliver the message unchanged
+	FilterRedact                     // Deliver the message with the offending parts replaced
+	FilterFlag                       // Hold the message in the review queue until an admin decides
+	FilterReject                     // Refuse the message outright
+)
+
+// String returns a readable name for the action, used in logs and the review queue.
+func (a FilterAction) String() string {
+	switch a {
+	case FilterAllow:
+		return "allow"
+	case FilterRedact:
+		return "redact"
+	case FilterFlag:
+		return "flag"
+	case FilterReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// FilterResult is what a single filter returns for a message.
+type FilterResult struct {
+	Action  FilterAction // What should happen with the message
+	Message string       // Rewritten message content, only used with FilterRedact
+	Reason  string       // Human readable explanation for reject and flag decisions
+}
+
+// MessageFilter inspects an outgoing message before it is stored.
+type MessageFilter interface {
+	Filter(msg Message) FilterResult
+}
+
+// ModerationPipeline runs a chain of MessageFilters over every outgoing message
+// and keeps the messages that were flagged in its review queue.
+type ModerationPipeline struct {
+	filters []MessageFilter
+	Queue   *ReviewQueue
+}
+
+// NewModerationPipeline creates a pipeline running the given filters in order
+func NewModerationPipeline(filters ...MessageFilter) *ModerationPipeline {
+	return &ModerationPipeline{
+		filters: filters,
+		Queue:   NewReviewQueue(),
+	}
+}
+
+// maxMessageLength is the longest message content in characters
+const maxMessageLength = 2000
+
+// messageSizeErrors returns the field errors of a message whose content is longer
+// than maxMessageLength, or whose ciphertext or envelopes exceed their limits.
+func messageSizeErrors(msg Message) []FieldError {
+	var errs []FieldError
+	if utf8.RuneCountInString(msg.Message) > maxMessageLength {
+		errs = append(errs, FieldError{Field: "Message", Message: "must be at most " + strconv.Itoa(maxMessageLength) + " characters"})
+	}
+	return append(errs, envelopeSizeErrors(msg)...)
+}
+
+// DefaultMessageFilters returns the filter chain used by the chat endpoints.
+func DefaultMessageFilters() []MessageFilter {
+	return []MessageFilter{
+		MaxLengthFilter{Max: maxMessageLength},
+		&ProfanityFilter{Words: []string{"damn", "crap"}, Redact: true},
+		LinkFilter{AllowedSchemes: []string{"http", "https"}, Action: FilterFlag},
+		NewSpamFilter(time.Minute, 3),
+	}
+}
+
+// moderation is the pipeline shared by all message sending endpoints
+var moderation = NewModerationPipeline(DefaultMessageFilters()...)
+
+// Run passes msg through every filter. Redactions are applied as they happen so
+// later filters see the rewritten content, a reject stops the chain immediately,
+// and a flag is remembered while the remaining filters still get their say.
+func (p *ModerationPipeline) Run(msg Message) (Message, FilterResult) {
+	verdict := FilterResult{Action: FilterAllow}
+
+	for _, f := range p.filters {
+		res := f.Filter(msg)
+		switch res.Action {
+		case FilterReject:
+			return msg, res
+		case FilterFlag:
+			if verdict.Action < FilterFlag {
+				verdict = res
+			}
+		case FilterRedact:
+			msg.Message = res.Message
+			if verdict.Action < FilterRedact {
+				verdict = res
+			}
+		}
+	}
+	return msg, verdict
+}
+
+// Screen runs msg through the pipeline and puts it into the review queue if it
+// is flagged, to be handed to deliver once an admin approves it. The caller
+// stores the message only if the action is below FilterFlag.
+func (p *ModerationPipeline) Screen(msg Message, deliver func(Message) error) (Message, FilterResult) {
+	msg, res := p.Run(msg)
+
+	switch res.Action {
+	case FilterReject:
+		fmt.Printf("Rejected message from %s: %s\n", msg.SenderID, res.Reason)
+	case FilterFlag:
+		p.Queue.Add(msg, res.Reason, deliver)
+		fmt.Printf("Flagged message from %s for review: %s\n", msg.SenderID, res.Reason)
+	}
+	return msg, res
+}
+
+// Moderate screens msg on behalf of a JSON API handler.
+// Rejected and flagged messages are answered right here; for those ok is false
+// and the handler must not store the message. Flagged messages are handed to
+// deliver once an admin approves them.
+func (p *ModerationPipeline) Moderate(w http.ResponseWriter, r *http.Request, msg Message, deliver func(Message) error) (Message, bool) {
+	msg, res := p.Screen(msg, deliver)
+
+	switch res.Action {
+	case FilterReject:
+		WriteProblem(w, r, NewProblem(http.StatusUnprocessableEntity, "Message rejected: "+res.Reason))
+		return msg, false
+	case FilterFlag:
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "Message held for review")
+		return msg, false
+	}
+	return msg, true
+}
+
+// Filters
+
+// MaxLengthFilter rejects messages longer than Max characters.
+type MaxLengthFilter struct {
+	Max int
+}
+
+// Filter implements MessageFilter
+func (f MaxLengthFilter) Filter(msg Message) FilterResult {
+	if n := utf8.RuneCountInString(msg.Message); n > f.Max {
+		return FilterResult{Action: FilterReject, Reason: fmt.Sprintf("message is %d characters long, the limit is %d", n, f.Max)}
+	}
+	return FilterResult{Action: FilterAllow}
+}
+
+// ProfanityFilter matches whole words from a word list, ignoring case.
+// With Redact set the words are masked, otherwise the message is rejected.
+type ProfanityFilter struct {
+	Words  []string
+	Redact bool
+
+	once    sync.Once
+	pattern *regexp.Regexp
+}
+
+// Filter implements MessageFilter
+func (f *ProfanityFilter) Filter(msg Message) FilterResult {
+	f.once.Do(func() {
+		quoted := make([]string, 0, len(f.Words))
+		for _, w := range f.Words {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+		if len(quoted) > 0 {
+			f.pattern = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+		}
+	})
+
+	if f.pattern == nil || !f.pattern.MatchString(msg.Message) {
+		return FilterResult{Action: FilterAllow}
+	}
+	if !f.Redact {
+		return FilterResult{Action: FilterReject, Reason: "message contains blocked words"}
+	}
+
+	redacted := f.pattern.ReplaceAllStringFunc(msg.Message, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	return FilterResult{Action: FilterRedact, Message: redacted, Reason: "blocked words redacted"}
+}
+
+// urlPattern finds links in message content
+var urlPattern = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://[^\s<>"]+`)
+
+// LinkFilter enforces a policy on links in messages. Links with a scheme outside
+// AllowedSchemes, or a host outside AllowedHosts (when that list is not empty),
+// get Action applied to the message.
+type LinkFilter struct {
+	AllowedSchemes []string
+	AllowedHosts   []string
+	Action         FilterAction
+}
+
+// Filter implements MessageFilter
+func (f LinkFilter) Filter(msg Message) FilterResult {
+	for _, link := range urlPattern.FindAllString(msg.Message, -1) {
+		u, err := url.Parse(link)
+		if err != nil {
+			return FilterResult{Action: f.Action, Reason: "message contains a malformed link"}
+		}
+		if !containsFold(f.AllowedSchemes, u.Scheme) {
+			return FilterResult{Action: f.Action, Reason: "links with scheme " + u.Scheme + " are not allowed"}
+		}
+		if len(f.AllowedHosts) > 0 && !containsFold(f.AllowedHosts, u.Hostname()) {
+			return FilterResult{Action: f.Action, Reason: "links to " + u.Hostname() + " are not allowed"}
+		}
+	}
+	return FilterResult{Action: FilterAllow}
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SpamFilter flags a sender who repeats the same message more than MaxRepeats
+// times within Window.
+type SpamFilter struct {
+	Window     time.Duration
+	MaxRepeats int
+
+	mu     sync.Mutex
+	recent map[string][]sentMessage // Recent messages per sender
+}
+
+// sentMessage is a message remembered by the SpamFilter
+type sentMessage struct {
+	content string
+	at      time.Time
+}
+
+// NewSpamFilter creates a SpamFilter
+func NewSpamFilter(window time.Duration, maxRepeats int) *SpamFilter {
+	return &SpamFilter{
+		Window:     window,
+		MaxRepeats: maxRepeats,
+		recent:     make(map[string][]sentMessage),
+	}
+}
+
+// Filter implements MessageFilter
+func (f *SpamFilter) Filter(msg Message) FilterResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	content := strings.ToLower(strings.TrimSpace(msg.Message))
+
+	// Forget everything that fell out of the window
+	kept := f.recent[msg.SenderID][:0]
+	repeats := 0
+	for _, m := range f.recent[msg.SenderID] {
+		if now.Sub(m.at) > f.Window {
+			continue
+		}
+		kept = append(kept, m)
+		if m.content == content {
+			repeats++
+		}
+	}
+	f.recent[msg.SenderID] = append(kept, sentMessage{content: content, at: now})
+
+	if repeats >= f.MaxRepeats {
+		return FilterResult{Action: FilterFlag, Reason: "same message repeated " + strconv.Itoa(repeats+1) + " times"}
+	}
+	return FilterResult{Action: FilterAllow}
+}
+
+// Review queue
+
+// FlaggedMessage is a message waiting for an admin decision.
+type FlaggedMessage struct {
+	ID        string
+	Message   Message
+	Reason    string
+	FlaggedAt time.Time
+
+	deliver func(Message) error // Stores the message once it is approved
+}
+
+// ReviewQueue holds flagged messages until an admin approves or rejects them.
+type ReviewQueue struct {
+	mu    sync.Mutex
+	items map[string]FlaggedMessage
+}
+
+// NewReviewQueue creates an empty ReviewQueue
+func NewReviewQueue() *ReviewQueue {
+	return &ReviewQueue{items: make(map[string]FlaggedMessage)}
+}
+
+// Add puts a message into the queue and returns its queue ID
+func (q *ReviewQueue) Add(msg Message, reason string, deliver func(Message) error) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := NewID()
+	q.items[id] = FlaggedMessage{
+		ID:        id,
+		Message:   msg,
+		Reason:    reason,
+		FlaggedAt: time.Now(),
+		deliver:   deliver,
+	}
+	return id
+}
+
+// List returns all queued messages, oldest first
+func (q *ReviewQueue) List() []FlaggedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]FlaggedMessage, 0, len(q.items))
+	for _, item := range q.items {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FlaggedAt.Before(list[j].FlaggedAt) })
+	return list
+}
+
+// HoldsPoll reports whether the message of a poll is waiting in the queue
+func (q *ReviewQueue) HoldsPoll(pollID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, item := range q.items {
+		if item.Message.PollID == pollID {
+			return true
+		}
+	}
+	return false
+}
+
+// Take removes a message from the queue and returns it
+func (q *ReviewQueue) Take(id string) (FlaggedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[id]
+	if ok {
+		delete(q.items, id)
+	}
+	return item, ok
+}
+
+// HTTP Handlers
+
+// ReviewQueueHandler lists the messages waiting for review
+func ReviewQueueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moderation.Queue.List())
+}
+
+// ResolveReviewHandler approves or rejects a flagged message.
+// The decision is passed as ?action=approve or ?action=reject.
+func ResolveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	action := r.URL.Query().Get("action")
+	if action != "approve" && action != "reject" {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "action must be approve or reject"))
+		return
+	}
+
+	item, ok := moderation.Queue.Take(id)
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Flagged message not found"))
+		return
+	}
+
+	if action == "approve" {
+		if err := item.deliver(item.Message); err != nil {
+			WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error delivering message"))
+			return
+		}
+	} else if item.Message.PollID != "" {
+		// The poll of a rejected message never opens for votes
+		polls.Remove(item.Message.PollID)
+	}
+	audit(r, action+"_flagged_message", id, item.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
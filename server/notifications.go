@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of notifications
+const (
+	NotifyMention      = "mention"      // Someone @mentioned the user
+	NotifyConversation = "conversation" // Someone started a conversation with the user
+	NotifyAnnouncement = "announcement" // An admin published an announcement
+)
+
+// Notification alerts a user about something that happened outside their inbox.
+type Notification struct {
+	ID        string
+	UserID    string // User being notified
+	Kind      string // One of the Notify* kinds
+	Text      string
+	FromID    string `json:",omitempty"` // User who caused the notification
+	MessageID string `json:",omitempty"` // Message the notification is about
+	CreatedAt time.Time
+	Read      bool
+}
+
+// NotificationPrefs selects which kinds of notifications a user gets.
+type NotificationPrefs struct {
+	Mentions         bool
+	NewConversations bool
+	Announcements    bool
+}
+
+// defaultNotificationPrefs applies to users who never changed their preferences
+var defaultNotificationPrefs = NotificationPrefs{Mentions: true, NewConversations: true, Announcements: true}
+
+// maxNotifications is how many notifications are kept per user, older ones are dropped
+const maxNotifications = 500
+
+// NotificationCenter keeps the notifications and preferences of all users.
+type NotificationCenter struct {
+	mu     sync.Mutex
+	byUser map[string][]Notification // User ID -> notifications, oldest first
+	prefs  map[string]NotificationPrefs
+}
+
+// NewNotificationCenter creates an empty NotificationCenter
+func NewNotificationCenter() *NotificationCenter {
+	return &NotificationCenter{
+		byUser: make(map[string][]Notification),
+		prefs:  make(map[string]NotificationPrefs),
+	}
+}
+
+// notifications is the notification center of the chat
+var notifications = NewNotificationCenter()
+
+// Prefs returns the notification preferences of a user
+func (nc *NotificationCenter) Prefs(userID string) NotificationPrefs {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.prefsOf(userID)
+}
+
+// prefsOf is Prefs for callers already holding nc.mu
+func (nc *NotificationCenter) prefsOf(userID string) NotificationPrefs {
+	if prefs, ok := nc.prefs[userID]; ok {
+		return prefs
+	}
+	return defaultNotificationPrefs
+}
+
+// SetPrefs changes the notification preferences of a user
+func (nc *NotificationCenter) SetPrefs(userID string, prefs NotificationPrefs) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.prefs[userID] = prefs
+}
+
+// Notify adds a notification for n.UserID, unless their preferences turn that kind off.
+// Returns false if the notification was not added.
+func (nc *NotificationCenter) Notify(n Notification) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	prefs := nc.prefsOf(n.UserID)
+	switch n.Kind {
+	case NotifyMention:
+		if !prefs.Mentions {
+			return false
+		}
+	case NotifyConversation:
+		if !prefs.NewConversations {
+			return false
+		}
+	case NotifyAnnouncement:
+		if !prefs.Announcements {
+			return false
+		}
+	}
+
+	n.ID = NewID()
+	n.CreatedAt = time.Now()
+	n.Read = false
+
+	list := append(nc.byUser[n.UserID], n)
+	if len(list) > maxNotifications {
+		list = list[len(list)-maxNotifications:]
+	}
+	nc.byUser[n.UserID] = list
+	return true
+}
+
+// List returns the notifications of a user, newest first
+func (nc *NotificationCenter) List(userID string, unreadOnly bool) []Notification {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	all := nc.byUser[userID]
+	list := make([]Notification, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		if !unreadOnly || !all[i].Read {
+			list = append(list, all[i])
+		}
+	}
+	return list
+}
+
+// MarkRead marks one notification of a user as read, or all of them if id is
+// empty. Returns false if the notification does not exist.
+func (nc *NotificationCenter) MarkRead(userID, id string) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	found := false
+	for i := range nc.byUser[userID] {
+		if id == "" || nc.byUser[userID][i].ID == id {
+			nc.byUser[userID][i].Read = true
+			found = true
+		}
+	}
+	return found || id == ""
+}
+
+// mentionPattern finds @username mentions, but not e-mail addresses. A mention
+// doesn't end in . or -, so "hi @Marie." mentions Marie.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w(?:[\w.-]*\w)?)`)
+
+// mentionedUsers returns the IDs of the users mentioned in msg, without the sender
+func (cs *ChatService) mentionedUsers(msg Message) []string {
+	// The server can't look into encrypted messages for mentions
+	if msg.IsEncrypted() {
+		return nil
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(msg.Message, -1) {
+		id, ok := cs.UserIDByName(m[1])
+		if !ok || id == msg.SenderID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// notifyForMessage creates the mention and new conversation notifications for a
+// message that was just delivered by the user named sender.
+func notifyForMessage(msg Message, sender string, mentioned []string, firstInConversation bool) {
+	if firstInConversation {
+		notifications.Notify(Notification{
+			UserID:    msg.ReceiverID,
+			Kind:      NotifyConversation,
+			Text:      sender + " started a conversation with you",
+			FromID:    msg.SenderID,
+			MessageID: msg.ID,
+		})
+	}
+
+	for _, id := range mentioned {
+		notifications.Notify(Notification{
+			UserID:    id,
+			Kind:      NotifyMention,
+			Text:      sender + " mentioned you",
+			FromID:    msg.SenderID,
+			MessageID: msg.ID,
+		})
+	}
+}
+
+// HTTP Handlers
+
+// GetNotificationsHandler lists the notifications of the calling user, newest first.
+// ?unread=true returns only unread ones.
+func (cs *ChatService) GetNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications.List(userID, unreadOnly))
+}
+
+// MarkNotificationReadHandler marks one notification of the calling user as read
+func (cs *ChatService) MarkNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	if !notifications.MarkRead(userID, mux.Vars(r)["id"]) {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Notification not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MarkAllNotificationsReadHandler marks all notifications of the calling user as read
+func (cs *ChatService) MarkAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	notifications.MarkRead(userID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetNotificationPrefsHandler returns the notification preferences of the calling user
+func (cs *ChatService) GetNotificationPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications.Prefs(userID))
+}
+
+// SetNotificationPrefsHandler replaces the notification preferences of the calling user
+func (cs *ChatService) SetNotificationPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	var prefs NotificationPrefs
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+
+	notifications.SetPrefs(userID, prefs)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
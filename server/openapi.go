@@ -0,0 +1,650 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Who may call an API operation
+const (
+	authNone  = ""      // Anyone
+	authJWT   = "jwt"   // Any user with a valid JWT
+	authAdmin = "admin" // Only users whose JWT has the admin role
+	authSelf  = "self"  // Admins, or the user the path refers to
+)
+
+// apiOperation describes one route for the OpenAPI document.
+type apiOperation struct {
+	Method     string
+	Path       string // Path template as registered with the router
+	Tag        string
+	Summary    string
+	Auth       string
+	Request    interface{} // Example value of the JSON request body, nil if there is none
+	Response   interface{} // Example value of the JSON response body, nil if there is none
+	Status     int         // Status of a successful response
+	HTML       bool        // The route serves an HTML page or form instead of JSON
+	Produces   string      // Media type of a response that is neither JSON nor HTML, like text/event-stream
+	Params     []apiParam  // Query parameters
+	Deprecated bool        // The route is an unversioned alias of an /api/v1 route
+	NoAlias    bool        // The /api/v1 route was added after the aliases, see API.HandleV1
+}
+
+// NewUser is the request body of POST /users: a User without the fields the server assigns.
+// It only documents the body, CreateUser decodes into a User and rejects an id.
+type NewUser struct {
+	Name string `json:"name" validate:"required,max=64,nocontrol"`
+}
+
+// apiParam is a query parameter of an API operation.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiOperations lists every route registered in newRouter, RegisterRoutes and RegisterChatRoutes.
+// Add new routes here as well, CheckOpenAPICoverage reports the ones that are missing.
+// The deprecated aliases of /api/v1 routes are added by documentedOperations.
+var apiOperations = []apiOperation{
+	// Browser pages from pages.go and Server.go
+	{Method: "GET", Path: "/", Tag: "pages", Summary: "Home page with the access counter and announcements", HTML: true},
+	{Method: "GET", Path: "/header", Tag: "pages", Summary: "Echo the request headers as plain text", HTML: true},
+	{Method: "GET", Path: "/ClientInfo", Tag: "pages", Summary: "Describe the client platform from its headers", HTML: true},
+	{Method: "GET", Path: "/info", Tag: "pages", Summary: "General information about the server", HTML: true},
+	{Method: "GET", Path: "/register", Tag: "pages", Summary: "Registration form", HTML: true},
+	{Method: "POST", Path: "/restful/register", Tag: "pages", Summary: "Register a user from the registration form", HTML: true, Status: http.StatusOK},
+	{Method: "GET", Path: "/login", Tag: "pages", Summary: "Login form", HTML: true},
+	{Method: "POST", Path: "/restful/login", Tag: "pages", Summary: "Log in from the login form, API clients use /api/v1/login", HTML: true, Status: http.StatusOK},
+	{Method: "GET", Path: "/send", Tag: "pages", Summary: "Form for sending a message", HTML: true},
+	{Method: "POST", Path: "/restful/send", Tag: "pages", Summary: "Send a message from the message form", HTML: true, Status: http.StatusOK},
+
+	// User resource from restful.go
+	{Method: "GET", Path: "/api/v1/users", Tag: "users", Summary: "List users with filters, sorting and pagination", Response: []User{}, Params: []apiParam{
+		{"id", "string", "Exact user ID"},
+		{"name", "string", "Exact name, ignoring case"},
+		{"q", "string", "Prefix of the name, ignoring case"},
+		{"created_after", "string", "RFC 3339 timestamp"},
+		{"created_before", "string", "RFC 3339 timestamp"},
+		{"sort", "string", "Comma separated fields out of id, name and created_at, prefixed with - for descending"},
+		{"limit", "integer", "Page size, 1 to 200"},
+		{"offset", "integer", "Number of users to skip"},
+		{"cursor", "string", "Cursor from the X-Next-Cursor header of the previous page"},
+	}},
+	{Method: "POST", Path: "/api/v1/users", Tag: "users", Summary: "Create a user, the server assigns its ID", Auth: authAdmin, Request: NewUser{}, Response: User{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/users/{id}", Tag: "users", Summary: "Get a user", Response: User{}},
+	{Method: "PUT", Path: "/api/v1/users/{id}", Tag: "users", Summary: "Replace a user, requires If-Match", Auth: authSelf, Request: User{}, Response: User{}},
+	{Method: "PATCH", Path: "/api/v1/users/{id}", Tag: "users", Summary: "Patch a user with a JSON Merge Patch or JSON Patch, requires If-Match", Auth: authSelf, Request: map[string]interface{}{}, Response: User{}},
+	{Method: "DELETE", Path: "/api/v1/users/{id}", Tag: "users", Summary: "Delete a user, requires If-Match", Auth: authAdmin, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v1/login", Tag: "users", Summary: "Log in with name and password and get a JWT", Request: LoginRequest{}, Response: LoginResponse{}, NoAlias: true},
+
+	// Messages, threads and conversations from chatapp.go and threads.go
+	{Method: "POST", Path: "/api/v1/messages", Tag: "messages", Summary: "Send a message as the caller, or schedule it with send_at. Only admins may give another SenderID. Flagged messages are held for review with 202", Auth: authJWT, Request: struct {
+		Message
+		SendAt *time.Time `json:"send_at"`
+	}{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/messages/{id}", Tag: "messages", Summary: "Inbox of a user", Auth: authSelf, Response: []Message{}},
+	{Method: "GET", Path: "/api/v1/messages/{id}/stream", Tag: "messages", Summary: "Stream the messages and poll results of a user as server-sent events", Auth: authSelf, Produces: "text/event-stream"},
+	{Method: "GET", Path: "/api/v1/threads/{id}", Tag: "messages", Summary: "A message and every reply below it, for its participants", Auth: authJWT, Response: []Message{}},
+	{Method: "GET", Path: "/api/v1/conversations/{id}/messages", Tag: "messages", Summary: "Messages of the conversation user1:user2, for its participants", Auth: authJWT, Response: []Message{}},
+	{Method: "PUT", Path: "/api/v1/conversations/{id}/timer", Tag: "messages", Summary: "Set the disappearing message timer of a conversation, 0 turns it off", Auth: authJWT, Request: struct{ Seconds int64 }{}, Status: http.StatusNoContent},
+
+	// Polls from polls.go
+	{Method: "POST", Path: "/api/v1/polls", Tag: "polls", Summary: "Send a poll to ReceiverID", Auth: authJWT, Request: struct {
+		ReceiverID     string
+		Question       string
+		Options        []string
+		MultipleChoice bool
+		Anonymous      bool
+		ClosesAt       *time.Time
+	}{}, Response: PollResults{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/polls/{id}", Tag: "polls", Summary: "Results of a poll, for its participants", Auth: authJWT, Response: PollResults{}},
+	{Method: "POST", Path: "/api/v1/polls/{id}/votes", Tag: "polls", Summary: "Vote on a poll, an empty list withdraws the vote", Auth: authJWT, Request: struct{ Options []int }{}, Response: PollResults{}},
+	{Method: "POST", Path: "/api/v1/polls/{id}/close", Tag: "polls", Summary: "Close a poll, for its creator", Auth: authJWT, Response: PollResults{}},
+
+	// Scheduled messages from scheduler.go
+	{Method: "GET", Path: "/api/v1/scheduled", Tag: "messages", Summary: "Pending scheduled messages of the caller", Auth: authJWT, Response: []ScheduledMessage{}},
+	{Method: "PUT", Path: "/api/v1/scheduled/{id}", Tag: "messages", Summary: "Change the content or send time of a scheduled message", Auth: authJWT, Request: struct {
+		Message *string
+		SendAt  *time.Time `json:"send_at"`
+	}{}, Response: ScheduledMessage{}},
+	{Method: "DELETE", Path: "/api/v1/scheduled/{id}", Tag: "messages", Summary: "Cancel a scheduled message", Auth: authJWT, Status: http.StatusNoContent},
+
+	// Notification center from notifications.go
+	{Method: "GET", Path: "/api/v1/notifications", Tag: "notifications", Summary: "Notifications of the caller, newest first", Auth: authJWT, Response: []Notification{}, Params: []apiParam{
+		{"unread", "boolean", "Only unread notifications"},
+	}},
+	{Method: "POST", Path: "/api/v1/notifications/read", Tag: "notifications", Summary: "Mark all notifications of the caller as read", Auth: authJWT, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v1/notifications/{id}/read", Tag: "notifications", Summary: "Mark a notification as read", Auth: authJWT, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/notifications/preferences", Tag: "notifications", Summary: "Notification preferences of the caller", Auth: authJWT, Response: NotificationPrefs{}},
+	{Method: "PUT", Path: "/api/v1/notifications/preferences", Tag: "notifications", Summary: "Change the notification preferences of the caller", Auth: authJWT, Request: NotificationPrefs{}, Response: NotificationPrefs{}},
+
+	// Key directory from keys.go
+	{Method: "GET", Path: "/api/v1/keys/{id}", Tag: "keys", Summary: "Current device keys of a user", Response: []DeviceKey{}},
+	{Method: "PUT", Path: "/api/v1/keys/{id}/{device}", Tag: "keys", Summary: "Publish or rotate the key of one of the caller's devices", Auth: authJWT, Request: struct {
+		Algorithm string
+		PublicKey []byte
+	}{}, Response: DeviceKey{}},
+	{Method: "DELETE", Path: "/api/v1/keys/{id}/{device}", Tag: "keys", Summary: "Revoke the key of one of the caller's devices", Auth: authJWT, Status: http.StatusNoContent},
+
+	// Announcements from announcements.go
+	{Method: "GET", Path: "/api/v1/announcements", Tag: "announcements", Summary: "Active announcements for the role of the caller", Response: []Announcement{}},
+	{Method: "POST", Path: "/api/v1/announcements/{id}/dismiss", Tag: "announcements", Summary: "Hide an announcement from the home page of this browser", HTML: true, Status: http.StatusSeeOther},
+
+	// Data export from export.go
+	{Method: "GET", Path: "/api/v1/me/export", Tag: "export", Summary: "Download every message of the caller", Auth: authJWT, Produces: "application/octet-stream", Params: []apiParam{exportFormat}},
+
+	// Admin tools from moderation.go, admin.go, audit.go, retention.go, announcements.go and export.go
+	{Method: "GET", Path: "/api/v1/admin/review", Tag: "admin", Summary: "Messages flagged for review, oldest first", Auth: authAdmin, Response: []FlaggedMessage{}},
+	{Method: "POST", Path: "/api/v1/admin/review/{id}", Tag: "admin", Summary: "Approve or reject a flagged message", Auth: authAdmin, Status: http.StatusNoContent, Params: []apiParam{
+		{"action", "string", "approve or reject"},
+	}},
+	{Method: "GET", Path: "/api/v1/admin/messages", Tag: "admin", Summary: "Search all messages", Auth: authAdmin, Response: []Message{}, Params: []apiParam{
+		{"q", "string", "Text the message contains, ignoring case"},
+		{"sender", "string", "ID of the sender"},
+		{"receiver", "string", "ID of the receiver"},
+		{"limit", "integer", "Maximum number of messages"},
+	}},
+	{Method: "DELETE", Path: "/api/v1/admin/messages/{id}", Tag: "admin", Summary: "Delete a message, one with replies stays as a placeholder", Auth: authAdmin, Status: http.StatusNoContent},
+	{Method: "PUT", Path: "/api/v1/admin/users/{id}/suspension", Tag: "admin", Summary: "Suspend a user for Seconds", Auth: authAdmin, Request: struct {
+		Seconds int64
+		Reason  string
+	}{}, Status: http.StatusNoContent},
+	{Method: "DELETE", Path: "/api/v1/admin/users/{id}/suspension", Tag: "admin", Summary: "Lift the suspension of a user", Auth: authAdmin, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/users/{id}/activity", Tag: "admin", Summary: "Message activity of a user", Auth: authAdmin, Response: UserActivity{}},
+	{Method: "PUT", Path: "/api/v1/admin/users/{id}/role", Tag: "admin", Summary: "Change the role of a user", Auth: authAdmin, Request: struct{ Role string }{}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/users/{id}/export", Tag: "admin", Summary: "Download every message of a user", Auth: authAdmin, Produces: "application/octet-stream", Params: []apiParam{exportFormat}},
+	{Method: "GET", Path: "/api/v1/admin/audit", Tag: "admin", Summary: "Audit trail of admin actions, newest first", Auth: authAdmin, Response: []AuditEntry{}, Params: []apiParam{
+		{"limit", "integer", "Maximum number of entries"},
+	}},
+	{Method: "PUT", Path: "/api/v1/admin/retention", Tag: "admin", Summary: "Set how long messages are kept, 0 keeps them forever", Auth: authAdmin, Request: struct{ MaxAgeSeconds int64 }{}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v1/admin/holds", Tag: "admin", Summary: "Legal holds that exempt users from retention", Auth: authAdmin, Response: []LegalHold{}},
+	{Method: "PUT", Path: "/api/v1/admin/holds/{id}", Tag: "admin", Summary: "Place a legal hold on a user", Auth: authAdmin, Request: struct{ Reason string }{}, Status: http.StatusNoContent},
+	{Method: "DELETE", Path: "/api/v1/admin/holds/{id}", Tag: "admin", Summary: "Release the legal hold of a user", Auth: authAdmin, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/v1/admin/announcements", Tag: "admin", Summary: "Publish an announcement and deliver it to its audience", Auth: authAdmin, Request: struct {
+		Text      string
+		Roles     []string
+		ExpiresAt *time.Time
+	}{}, Response: Announcement{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/admin/announcements", Tag: "admin", Summary: "All announcements including expired ones", Auth: authAdmin, Response: []Announcement{}},
+	{Method: "DELETE", Path: "/api/v1/admin/announcements/{id}", Tag: "admin", Summary: "Withdraw an announcement", Auth: authAdmin, Status: http.StatusNoContent},
+
+	// GraphQL from graphql_api.go, outside of the versioned API
+	{Method: "GET", Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query, subscriptions are answered with server-sent events", Response: gqlResponse{}, Params: []apiParam{
+		{"query", "string", "The GraphQL document"},
+		{"operationName", "string", "Operation to run if the document has several"},
+		{"variables", "string", "JSON object with the variables"},
+	}},
+	{Method: "POST", Path: "/graphql", Tag: "graphql", Summary: "Run a GraphQL query, mutation or subscription", Request: struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}{}, Response: gqlResponse{}},
+	{Method: "GET", Path: "/graphql/schema", Tag: "graphql", Summary: "The GraphQL schema in SDL", Produces: "text/plain"},
+
+	// This document
+	{Method: "GET", Path: "/openapi.json", Tag: "docs", Summary: "This OpenAPI document", Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/docs", Tag: "docs", Summary: "Interactive API documentation", HTML: true},
+}
+
+// exportFormat is the query parameter selecting the format of an export
+var exportFormat = apiParam{"format", "string", "json (default), csv or mbox"}
+
+// documentedOperations returns apiOperations together with the deprecated
+// unversioned alias of every /api/v1 operation
+func documentedOperations() []apiOperation {
+	ops := append([]apiOperation(nil), apiOperations...)
+	for _, op := range apiOperations {
+		if strings.HasPrefix(op.Path, apiV1Prefix+"/") && !op.NoAlias {
+			op.Path = strings.TrimPrefix(op.Path, apiV1Prefix)
+			op.Deprecated = true
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// pathVariable matches a mux path variable, with or without a pattern
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+// openAPIPath turns a mux path template into an OpenAPI path
+func openAPIPath(template string) string {
+	return pathVariable.ReplaceAllString(template, "{$1}")
+}
+
+// schemaBuilder derives JSON schemas from Go types and collects the named ones as components.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	bytesType = reflect.TypeOf([]byte(nil))
+	rawType   = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schema returns the JSON schema of t, a reference for named struct types
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]interface{}{}
+	case t == bytesType:
+		return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, done := b.components[t.Name()]; !done {
+			b.components[t.Name()] = nil // Placeholder, so recursive types terminate
+			b.components[t.Name()] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the object schema of a struct, following encoding/json's rules
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				addFields(field.Type)
+				continue
+			}
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			prop := b.schema(field.Type)
+			for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+				rule, arg, _ := strings.Cut(rule, "=")
+				switch {
+				case rule == "required":
+					required = append(required, name)
+				case rule == "max" && field.Type.Kind() == reflect.String:
+					prop["maxLength"] = json.Number(arg)
+				case rule == "min" && field.Type.Kind() == reflect.String:
+					prop["minLength"] = json.Number(arg)
+				}
+			}
+			properties[name] = prop
+		}
+	}
+	addFields(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// BuildOpenAPISpec builds the OpenAPI 3.1 document for apiOperations
+func BuildOpenAPISpec() map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	problem := map[string]interface{}{
+		"description": "Error described as RFC 7807 problem details",
+		"content": map[string]interface{}{
+			"application/problem+json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(Problem{}))},
+		},
+	}
+
+	paths := make(map[string]interface{})
+	for _, op := range documentedOperations() {
+		path := openAPIPath(op.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case op.HTML:
+			success["content"] = map[string]interface{}{"text/html": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+		case op.Produces != "":
+			success["content"] = map[string]interface{}{op.Produces: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+		case op.Response != nil:
+			success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Response))}}
+		}
+		responses := map[string]interface{}{fmt.Sprint(status): success}
+		if !op.HTML {
+			responses["default"] = problem
+		}
+
+		operation := map[string]interface{}{
+			"tags":        []string{op.Tag},
+			"summary":     op.Summary,
+			"operationId": strings.ToLower(op.Method) + operationName(op.Path),
+			"responses":   responses,
+		}
+		if op.Deprecated {
+			operation["deprecated"] = true
+			operation["operationId"] = operation["operationId"].(string) + "Deprecated"
+			operation["description"] = "Use " + apiV1Prefix + openAPIPath(op.Path) + " instead, this path stops working on " + legacySunset.Format("2006-01-02") + "."
+		}
+
+		var params []interface{}
+		for _, name := range pathVariable.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": name[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, p := range op.Params {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": "query", "description": p.Description, "schema": map[string]interface{}{"type": p.Type},
+			})
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			content := map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Request))}}
+			if op.Method == "PATCH" {
+				content = map[string]interface{}{
+					mergePatchType: map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+					jsonPatchType:  map[string]interface{}{"schema": b.schema(reflect.TypeOf([]PatchOperation{}))},
+				}
+			}
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+
+		switch op.Auth {
+		case authJWT, authSelf:
+			operation["security"] = []interface{}{map[string]interface{}{"jwt": []string{}}}
+		case authAdmin:
+			operation["security"] = []interface{}{map[string]interface{}{"jwt": []string{"admin"}}}
+		}
+		if op.Auth == authSelf {
+			description, _ := operation["description"].(string)
+			operation["description"] = strings.TrimSpace("Allowed for admins and for the user the path refers to. " + description)
+		}
+
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "go-web-server",
+			"version":     "1.0.0",
+			"description": "User management, chat and browser pages of the go-web-server.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"jwt": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "JWT without a Bearer prefix. Admin only operations need the admin role in the token.",
+				},
+			},
+		},
+	}
+}
+
+// operationName turns a path into the CamelCase part of an operation ID.
+// The /api/v1 prefix is left out, so v1 operations keep the IDs they had before.
+func operationName(path string) string {
+	var name strings.Builder
+	for _, part := range strings.FieldsFunc(strings.TrimPrefix(openAPIPath(path), apiV1Prefix), func(r rune) bool { return r == '/' || r == '.' }) {
+		by := strings.HasPrefix(part, "{")
+		part = strings.Trim(part, "{}")
+		if by {
+			name.WriteString("By")
+		}
+		if part != "" {
+			name.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	if name.Len() == 0 {
+		return "Root"
+	}
+	return name.String()
+}
+
+// CheckOpenAPICoverage walks the router and returns the registered routes that are
+// missing from apiOperations, as "METHOD /path". Routes without methods count as GET.
+func CheckOpenAPICoverage(r *mux.Router) []string {
+	documented := make(map[string]bool)
+	for _, op := range documentedOperations() {
+		documented[op.Method+" "+openAPIPath(op.Path)] = true
+	}
+
+	var missing []string
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		// Routes without a handler only mount the /api subrouters
+		if route.GetHandler() == nil {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			if key := method + " " + openAPIPath(path); !documented[key] {
+				missing = append(missing, key)
+			}
+		}
+		return nil
+	})
+	sort.Strings(missing)
+	return missing
+}
+
+// HTTP Handlers
+
+// OpenAPIHandler serves the OpenAPI document
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BuildOpenAPISpec())
+}
+
+// DocsHandler serves an interactive documentation page built from /openapi.json.
+// It needs no assets from elsewhere.
+func DocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, docsPage)
+}
+
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>API Documentation</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            background-color: #f4f4f4;
+            color: #333;
+            margin: 0;
+            padding: 30px;
+        }
+        h1 {
+            color: #4CAF50;
+        }
+        .token {
+            margin-bottom: 20px;
+        }
+        .token input {
+            width: 60%;
+            padding: 8px;
+        }
+        details {
+            background-color: white;
+            border-radius: 8px;
+            box-shadow: 0 0 10px rgba(0, 0, 0, 0.1);
+            margin: 10px 0;
+            padding: 10px 15px;
+        }
+        summary {
+            cursor: pointer;
+        }
+        .method {
+            display: inline-block;
+            width: 70px;
+            font-weight: bold;
+            color: white;
+            text-align: center;
+            border-radius: 4px;
+            margin-right: 10px;
+        }
+        .get { background-color: #007BFF; }
+        .post { background-color: #4CAF50; }
+        .put { background-color: #f0ad4e; }
+        .patch { background-color: #5bc0de; }
+        .delete { background-color: #d9534f; }
+        .lock {
+            color: #d9534f;
+            margin-left: 10px;
+        }
+        textarea {
+            width: 100%;
+            height: 100px;
+            font-family: monospace;
+        }
+        pre {
+            background-color: #f1f1f1;
+            padding: 10px;
+            overflow: auto;
+        }
+        button {
+            background-color: #4CAF50;
+            border: none;
+            color: white;
+            padding: 8px 20px;
+            border-radius: 4px;
+            cursor: pointer;
+        }
+    </style>
+</head>
+<body>
+    <h1>API Documentation</h1>
+    <p>Generated from <a href="/openapi.json">/openapi.json</a>.</p>
+    <div class="token">
+        <label for="token">JWT for protected operations:</label>
+        <input type="text" id="token">
+    </div>
+    <div id="operations">Loading...</div>
+    <script>
+        function escapeHTML(s) {
+            return String(s).replace(/[&<>"']/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c]));
+        }
+
+        function resolve(spec, schema) {
+            if (schema && schema.$ref) {
+                return spec.components.schemas[schema.$ref.split('/').pop()];
+            }
+            return schema;
+        }
+
+        function render(spec) {
+            const container = document.getElementById('operations');
+            container.innerHTML = '';
+            for (const [path, item] of Object.entries(spec.paths)) {
+                for (const [method, op] of Object.entries(item)) {
+                    const el = document.createElement('details');
+                    const params = op.parameters || [];
+                    const body = op.requestBody ? Object.entries(op.requestBody.content)[0] : null;
+                    el.innerHTML =
+                        '<summary><span class="method ' + method + '">' + method.toUpperCase() + '</span>' +
+                        escapeHTML(path) + ' &mdash; ' + escapeHTML(op.summary) +
+                        (op.security ? '<span class="lock">&#128274; ' + (op.security[0].jwt.length ? 'admin' : 'JWT') + '</span>' : '') +
+                        '</summary>' +
+                        (op.description ? '<p>' + escapeHTML(op.description) + '</p>' : '') +
+                        params.map(p => '<p><label>' + escapeHTML(p.name) + ' (' + p.in + ') <input data-param="' + escapeHTML(p.name) + '" data-in="' + p.in + '"></label> ' + escapeHTML(p.description || '') + '</p>').join('') +
+                        (body ? '<p>Request body (' + escapeHTML(body[0]) + '):</p><pre>' + escapeHTML(JSON.stringify(resolve(spec, body[1].schema), null, 2)) + '</pre><textarea data-type="' + escapeHTML(body[0]) + '"></textarea>' : '') +
+                        '<p><button>Try it</button></p><pre class="result"></pre>';
+                    el.querySelector('button').onclick = () => tryIt(el, method, path);
+                    container.appendChild(el);
+                }
+            }
+        }
+
+        async function tryIt(el, method, path) {
+            const query = new URLSearchParams();
+            for (const input of el.querySelectorAll('input[data-param]')) {
+                if (input.dataset.in === 'path') {
+                    path = path.replace('{' + input.dataset.param + '}', encodeURIComponent(input.value));
+                } else if (input.value) {
+                    query.set(input.dataset.param, input.value);
+                }
+            }
+            const options = {method: method.toUpperCase(), headers: {}};
+            const token = document.getElementById('token').value;
+            if (token) {
+                options.headers['Authorization'] = token;
+            }
+            const textarea = el.querySelector('textarea');
+            if (textarea) {
+                options.headers['Content-Type'] = textarea.dataset.type;
+                options.body = textarea.value;
+            }
+            const result = el.querySelector('.result');
+            try {
+                const response = await fetch(path + (query.toString() ? '?' + query : ''), options);
+                result.textContent = response.status + ' ' + response.statusText + '\n\n' + await response.text();
+            } catch (err) {
+                result.textContent = String(err);
+            }
+        }
+
+        fetch('/openapi.json').then(r => r.json()).then(render).catch(err => {
+            document.getElementById('operations').textContent = 'Could not load the API description: ' + err;
+        });
+    </script>
+</body>
+</html>`
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter builds the router of the server with every route main registers,
+// without connecting to a database or starting the background work
+func newTestRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	userRepo = NewMemoryUserRepository()
+	cs := NewChatService()
+	cs.scheduler = NewScheduler(cs, NewMemoryScheduleStore())
+
+	r, api := newRouter()
+	RegisterChatRoutes(api, cs)
+	return r
+}
+
+// TestOpenAPICoversEveryRoute fails for every registered route that is missing from apiOperations
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	for _, route := range CheckOpenAPICoverage(newTestRouter(t)) {
+		t.Errorf("%s is not documented in apiOperations", route)
+	}
+}
+
+// TestOpenAPIHasNoStaleOperations fails for every documented operation without a route
+func TestOpenAPIHasNoStaleOperations(t *testing.T) {
+	registered := make(map[string]bool)
+	newTestRouter(t).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			registered[method+" "+openAPIPath(path)] = true
+		}
+		return nil
+	})
+
+	for _, op := range documentedOperations() {
+		if key := op.Method + " " + openAPIPath(op.Path); !registered[key] {
+			t.Errorf("%s is documented but not registered", key)
+		}
+	}
+}
+
+// TestOpenAPISchemas checks that the document encodes and carries the schemas of the chat
+func TestOpenAPISchemas(t *testing.T) {
+	spec := BuildOpenAPISpec()
+	if _, err := json.Marshal(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, name := range []string{"User", "NewUser", "Message", "PollResults", "Notification", "ScheduledMessage", "Problem"} {
+		if schemas[name] == nil {
+			names := make([]string, 0, len(schemas))
+			for name := range schemas {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			t.Errorf("schema %s is missing, got %v", name, names)
+		}
+	}
+
+	// The server assigns the ID of new users
+	if create, ok := schemas["NewUser"].(map[string]interface{}); ok {
+		if _, ok := create["properties"].(map[string]interface{})["id"]; ok {
+			t.Error("NewUser has an id")
+		}
+	}
+
+	ids := make(map[string]bool)
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method, op := range item.(map[string]interface{}) {
+			id := op.(map[string]interface{})["operationId"].(string)
+			if ids[id] {
+				t.Errorf("operationId %s of %s %s is not unique", id, method, path)
+			}
+			ids[id] = true
+		}
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var ( // shared resource
@@ -29,7 +28,7 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		WriteHTMLError(w, NewProblem(http.StatusMethodNotAllowed, "Invalid request method"))
 		return
 	}
 
@@ -82,9 +81,18 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
                 width: 300px;
                 border-radius: 8px;
             }
+            .announcement {
+                background-color: #fff3cd;
+                border: 1px solid #ffe08a;
+                border-radius: 4px;
+                padding: 10px;
+                margin: 0 auto 20px;
+                max-width: 600px;
+            }
         </style>
     </head>
     <body>
+        ` + announcementBanner(r) + `
         <h1>Welcome to My Homepage!</h1>
         <p class="counter">This page has been accessed <strong>` + strconv.Itoa(currentCount) + `</strong> times!</p>
         <p>
@@ -102,19 +110,19 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
     `
 
 	// Send the HTML response
-	fmt.Fprintf(w, htmlContent)
+	fmt.Fprint(w, htmlContent)
 }
 
 // RenderHTML serves a basic HTML form page
 func RenderHTML(w http.ResponseWriter, r *http.Request, tmpl string) {
 	t, err := template.New("form").Parse(tmpl)
 	if err != nil {
-		http.Error(w, "Error parsing template", http.StatusInternalServerError)
+		WriteHTMLError(w, NewProblem(http.StatusInternalServerError, "Error parsing template"))
 		return
 	}
 	err = t.Execute(w, nil)
 	if err != nil {
-		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		WriteHTMLError(w, NewProblem(http.StatusInternalServerError, "Error executing template"))
 	}
 }
 
@@ -191,9 +199,6 @@ func RegisterPage(w http.ResponseWriter, r *http.Request) {
 
                 <h1>Register</h1>
                 <form action="/restful/register" method="post">
-                    <label for="id">ID:</label>
-                    <input type="text" id="id" name="id" required>
-
                     <label for="name">Name:</label>
                     <input type="text" id="name" name="name" required>
 
@@ -208,30 +213,38 @@ func RegisterPage(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprint(w, form)
 	} else {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		WriteHTMLError(w, NewProblem(http.StatusMethodNotAllowed, "Invalid request method"))
 	}
 }
 
 // RegisterUser handles form submission for user registration
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
-		id := r.FormValue("id")
+		id := NewID()
 		name := r.FormValue("name")
+		if errs := Validate(User{ID: id, Name: name}); errs != nil {
+			WriteHTMLError(w, ValidationProblem(errs))
+			return
+		}
 		password, err := HashPassword(r.FormValue("password"))
 		if err != nil {
-			http.Error(w, "Error hashing password", http.StatusInternalServerError)
+			WriteHTMLError(w, NewProblem(http.StatusInternalServerError, "Error hashing password"))
 			return
 		}
 
-		_, err = db.Exec("INSERT INTO users (id, name, password) VALUES (?, ?, ?)", id, name, password)
-		if err != nil {
-			http.Error(w, "Error registering user", http.StatusInternalServerError)
+		user := ChatUser{
+			InternData:   User{ID: id, Name: strings.TrimSpace(name), CreatedAt: time.Now(), Version: 1},
+			HashPassword: password,
+			Role:         "user",
+		}
+		if err = userRepo.Create(user); err != nil {
+			WriteHTMLError(w, repoProblem(err))
 			return
 		}
 
-		fmt.Fprintf(w, "User %s registered successfully!", name)
+		fmt.Fprintf(w, "User %s registered successfully! Your ID is %s", name, id)
 	} else {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		WriteHTMLError(w, NewProblem(http.StatusMethodNotAllowed, "Invalid request method"))
 	}
 	http.Redirect(w, r, "/register", http.StatusSeeOther)
 }
@@ -327,28 +340,22 @@ func LoginPage(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprint(w, form)
 	} else {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		WriteHTMLError(w, NewProblem(http.StatusMethodNotAllowed, "Invalid request method"))
 	}
 }
 
 // LoginUser handles user login
 func LoginUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		WriteHTMLError(w, NewProblem(http.StatusMethodNotAllowed, "Invalid request method"))
 		return
 	}
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	var storedPassword string
-	err := db.QueryRow("SELECT password FROM users WHERE name = ?", username).Scan(&storedPassword)
-	if err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
-		return
-	}
-
-	if err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)); err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	user, err := userRepo.GetByName(username)
+	if err != nil || !CheckPassword(user, password) {
+		WriteHTMLError(w, NewProblem(http.StatusUnauthorized, "Invalid username or password"))
 		return
 	}
 
@@ -381,23 +388,26 @@ func SendMessagePage(w http.ResponseWriter, r *http.Request) {
 	RenderHTML(w, r, form)
 }
 
-// SendMessage handles sending a message
-func SendMessage(w http.ResponseWriter, r *http.Request) {
+// SendMessageFormHandler sends a message from the message form through the checks
+// and moderation of SendChecked, like POST /api/v1/messages
+func (cs *ChatService) SendMessageFormHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		WriteHTMLError(w, NewProblem(http.StatusMethodNotAllowed, "Invalid request method"))
 		return
 	}
-	senderID := r.FormValue("senderID")
-	receiverID := r.FormValue("receiverID")
-	message := r.FormValue("message")
+	msg := CreateMessage(r.FormValue("senderID"), r.FormValue("receiverID"), r.FormValue("message"))
 
-	_, err := db.Exec("INSERT INTO messages (sender_id, receiver_id, message, timestamp) VALUES (?, ?, ?, ?)",
-		senderID, receiverID, message, time.Now())
-	if err != nil {
-		http.Error(w, "Error sending message", http.StatusInternalServerError)
+	stored, p := cs.SendChecked(msg, "")
+	if p != nil {
+		WriteHTMLError(w, p)
+		return
+	}
+	if stored == nil {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "Message held for review")
 		return
 	}
 
-	fmt.Fprintf(w, "Message sent from %s to %s", senderID, receiverID)
+	fmt.Fprintf(w, "Message sent from %s to %s", stored.SenderID, stored.ReceiverID)
 	http.Redirect(w, r, "/send", http.StatusSeeOther)
 }
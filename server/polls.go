@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	pollMaxOptions   = 20  // Upper bound for the options of a poll
+	pollMaxOptionLen = 200 // Upper bound for the length of one option
+)
+
+// Poll is a question with fixed options that the two users of a conversation vote on.
+// It is sent as a message whose PollID refers to it.
+type Poll struct {
+	ID             string
+	SenderID       string // User who created the poll
+	ReceiverID     string // Other user of the conversation
+	Question       string
+	Options        []string
+	MultipleChoice bool       // Voters may pick more than one option
+	Anonymous      bool       // Results don't show who voted for what
+	ClosesAt       *time.Time `json:",omitempty"` // No votes are accepted after this
+	ClosedAt       *time.Time `json:",omitempty"` // Set when the creator closed the poll early
+	Pending        bool       `json:",omitempty"` // Its message waits for moderation review, no votes until it is approved
+	CreatedAt      time.Time
+
+	votes map[string][]int // Voter ID -> indexes of the chosen options
+}
+
+// Closed reports whether the poll no longer accepts votes
+func (p *Poll) Closed() bool {
+	return p.ClosedAt != nil || (p.ClosesAt != nil && !time.Now().Before(*p.ClosesAt))
+}
+
+// isParticipant reports whether the user may see and vote on the poll
+func (p *Poll) isParticipant(userID string) bool {
+	return userID == p.SenderID || userID == p.ReceiverID
+}
+
+// OptionResult is the tally of one poll option.
+type OptionResult struct {
+	Text   string
+	Votes  int
+	Voters []string `json:",omitempty"` // IDs of the users who chose it, left out for anonymous polls
+}
+
+// PollResults is the current state of a poll as seen by one user.
+type PollResults struct {
+	Poll
+	Results   []OptionResult
+	Voters    int   // Number of users who voted
+	Closed    bool  // Whether the poll no longer accepts votes
+	MyChoices []int `json:",omitempty"` // Options the viewing user chose
+}
+
+// results tallies the votes for the given viewer. An empty viewer gets the
+// results without any personal choices. The caller must hold the poll store lock.
+func (p *Poll) results(viewerID string) PollResults {
+	res := PollResults{
+		Poll:    *p,
+		Results: make([]OptionResult, len(p.Options)),
+		Voters:  len(p.votes),
+		Closed:  p.Closed(),
+	}
+	res.Poll.votes = nil
+	for i, text := range p.Options {
+		res.Results[i].Text = text
+	}
+
+	voters := make([]string, 0, len(p.votes))
+	for id := range p.votes {
+		voters = append(voters, id)
+	}
+	sort.Strings(voters)
+	for _, id := range voters {
+		for _, option := range p.votes[id] {
+			res.Results[option].Votes++
+			if !p.Anonymous {
+				res.Results[option].Voters = append(res.Results[option].Voters, id)
+			}
+		}
+	}
+	if viewerID != "" {
+		res.MyChoices = p.votes[viewerID]
+	}
+	return res
+}
+
+// PollStore keeps all polls.
+type PollStore struct {
+	mu    sync.Mutex
+	polls map[string]*Poll
+}
+
+// polls holds the polls of every conversation
+var polls = &PollStore{polls: make(map[string]*Poll)}
+
+// Create validates a new poll and stores it, assigning its ID
+func (ps *PollStore) Create(p Poll) (Poll, error) {
+	p.Question = strings.TrimSpace(p.Question)
+	if p.Question == "" {
+		return Poll{}, errors.New("a poll needs a question")
+	}
+	if len(p.Options) < 2 || len(p.Options) > pollMaxOptions {
+		return Poll{}, fmt.Errorf("a poll needs between 2 and %d options", pollMaxOptions)
+	}
+	seen := make(map[string]bool)
+	for i, option := range p.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || len(option) > pollMaxOptionLen {
+			return Poll{}, fmt.Errorf("options must be between 1 and %d characters long", pollMaxOptionLen)
+		}
+		if seen[strings.ToLower(option)] {
+			return Poll{}, errors.New("option " + option + " appears twice")
+		}
+		seen[strings.ToLower(option)] = true
+		p.Options[i] = option
+	}
+	if p.ClosesAt != nil && !p.ClosesAt.After(time.Now()) {
+		return Poll{}, errors.New("ClosesAt must be in the future")
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p.ID = NewID()
+	p.ClosedAt = nil
+	p.CreatedAt = time.Now()
+	p.votes = make(map[string][]int)
+	ps.polls[p.ID] = &p
+	return p, nil
+}
+
+// Remove deletes a poll, used when its message could not be sent
+func (ps *PollStore) Remove(id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.polls, id)
+}
+
+// Approve opens a pending poll for votes once its message was delivered
+func (ps *PollStore) Approve(id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if p, ok := ps.polls[id]; ok {
+		p.Pending = false
+	}
+}
+
+// Results returns the results of a poll as seen by a participant.
+// Returns false if the poll does not exist or the viewer is not a participant.
+func (ps *PollStore) Results(id, viewerID string) (PollResults, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.polls[id]
+	if !ok || !p.isParticipant(viewerID) {
+		return PollResults{}, false
+	}
+	return p.results(viewerID), true
+}
+
+// Errors returned when voting
+var (
+	ErrPollNotFound = errors.New("poll not found")
+	ErrPollClosed   = errors.New("poll is closed")
+	ErrPollPending  = errors.New("poll is waiting for moderation review")
+)
+
+// Vote records the choices of a participant, replacing an earlier vote.
+// An empty choice withdraws the vote.
+func (ps *PollStore) Vote(id, voterID string, choices []int) (PollResults, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.polls[id]
+	if !ok || !p.isParticipant(voterID) {
+		return PollResults{}, ErrPollNotFound
+	}
+	if p.Pending {
+		return PollResults{}, ErrPollPending
+	}
+	if p.Closed() {
+		return PollResults{}, ErrPollClosed
+	}
+	if len(choices) > 1 && !p.MultipleChoice {
+		return PollResults{}, errors.New("this poll allows only one choice")
+	}
+
+	picked := make(map[int]bool)
+	for _, option := range choices {
+		if option < 0 || option >= len(p.Options) {
+			return PollResults{}, fmt.Errorf("option %d does not exist", option)
+		}
+		if picked[option] {
+			return PollResults{}, fmt.Errorf("option %d is chosen twice", option)
+		}
+		picked[option] = true
+	}
+
+	if len(choices) == 0 {
+		delete(p.votes, voterID)
+	} else {
+		sorted := append([]int(nil), choices...)
+		sort.Ints(sorted)
+		p.votes[voterID] = sorted
+	}
+	return p.results(voterID), nil
+}
+
+// Close stops a poll from accepting votes. Only its creator may close it.
+func (ps *PollStore) Close(id, userID string) (PollResults, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.polls[id]
+	if !ok || !p.isParticipant(userID) {
+		return PollResults{}, ErrPollNotFound
+	}
+	if p.SenderID != userID {
+		return PollResults{}, errors.New("only the creator can close a poll")
+	}
+	if p.Closed() {
+		return PollResults{}, ErrPollClosed
+	}
+	now := time.Now()
+	p.ClosedAt = &now
+	return p.results(userID), nil
+}
+
+// publishResults pushes the new results of a poll to the stream of both participants
+func (cs *ChatService) publishResults(id string) {
+	polls.mu.Lock()
+	p, ok := polls.polls[id]
+	var res PollResults
+	if ok {
+		res = p.results("")
+	}
+	polls.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	event := MessageEvent{
+		Origin:  instanceID,
+		Kind:    EventPoll,
+		Message: Message{SenderID: res.SenderID, ReceiverID: res.ReceiverID, PollID: res.ID},
+		Poll:    &res,
+	}
+	if err := cs.broker.Publish(event); err != nil {
+		fmt.Println("Publishing poll results failed:", err)
+	}
+}
+
+// deliverPoll delivers the message of a pending poll and opens the poll for votes.
+// The poll is removed if the message can't be delivered.
+func (cs *ChatService) deliverPoll(msg Message) error {
+	if err := cs.Deliver(msg); err != nil {
+		polls.Remove(msg.PollID)
+		return err
+	}
+	polls.Approve(msg.PollID)
+	return nil
+}
+
+// HTTP Handlers
+
+// CreatePollHandler sends a poll from the calling user to ReceiverID
+func (cs *ChatService) CreatePollHandler(w http.ResponseWriter, r *http.Request) {
+	senderID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ReceiverID     string
+		Question       string
+		Options        []string
+		MultipleChoice bool
+		Anonymous      bool
+		ClosesAt       *time.Time
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+
+	if err := suspensions.Check(senderID); err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusForbidden, err.Error()))
+		return
+	}
+	if p := sendLimiter.Check(r, senderID, req.ReceiverID); p != nil {
+		WriteProblem(w, r, p)
+		return
+	}
+
+	poll, err := polls.Create(Poll{
+		SenderID:       senderID,
+		ReceiverID:     req.ReceiverID,
+		Question:       req.Question,
+		Options:        req.Options,
+		MultipleChoice: req.MultipleChoice,
+		Anonymous:      req.Anonymous,
+		ClosesAt:       req.ClosesAt,
+		Pending:        true,
+	})
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	// The message shows the question and options to clients that don't know polls,
+	// and goes through moderation like any other message. The poll takes no votes
+	// until its message is delivered.
+	msg := CreateMessage(senderID, req.ReceiverID, poll.Question+"\n"+strings.Join(poll.Options, "\n"))
+	msg.PollID = poll.ID
+	msg, ok = moderation.Moderate(w, r, msg, cs.deliverPoll)
+	if !ok {
+		// A flagged poll waits in the review queue, a rejected one is gone for good
+		if !moderation.Queue.HoldsPoll(poll.ID) {
+			polls.Remove(poll.ID)
+		}
+		return
+	}
+
+	if err := cs.deliverPoll(msg); err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, err.Error()))
+		return
+	}
+
+	res, _ := polls.Results(poll.ID, senderID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetPollHandler returns the current results of a poll to one of its participants
+func (cs *ChatService) GetPollHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	res, found := polls.Results(mux.Vars(r)["id"], userID)
+	if !found {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Poll not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// VotePollHandler records the vote of the calling user. The body lists the
+// indexes of the chosen options, e.g. {"Options": [0, 2]}; an empty list withdraws the vote.
+func (cs *ChatService) VotePollHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Options []int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	res, err := polls.Vote(id, userID, req.Options)
+	switch {
+	case errors.Is(err, ErrPollNotFound):
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Poll not found"))
+		return
+	case errors.Is(err, ErrPollClosed), errors.Is(err, ErrPollPending):
+		WriteProblem(w, r, NewProblem(http.StatusConflict, err.Error()))
+		return
+	case err != nil:
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	cs.publishResults(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// ClosePollHandler lets the creator of a poll stop it from accepting votes
+func (cs *ChatService) ClosePollHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	res, err := polls.Close(id, userID)
+	switch {
+	case errors.Is(err, ErrPollNotFound):
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Poll not found"))
+		return
+	case errors.Is(err, ErrPollClosed):
+		WriteProblem(w, r, NewProblem(http.StatusConflict, err.Error()))
+		return
+	case err != nil:
+		WriteProblem(w, r, NewProblem(http.StatusForbidden, err.Error()))
+		return
+	}
+
+	cs.publishResults(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Problem types beyond the plain HTTP status
+const (
+	problemValidation = "/problems/validation" // The payload failed validation, see Errors
+	problemMalformed  = "/problems/malformed"  // The payload is not valid JSON of the expected shape
+)
+
+// Problem is an RFC 7807 problem detail, the error format of the JSON API.
+type Problem struct {
+	Type     string       `json:"type"`               // URI identifying the kind of problem
+	Title    string       `json:"title"`              // Short summary of the kind of problem
+	Status   int          `json:"status"`             // HTTP status code
+	Detail   string       `json:"detail,omitempty"`   // Explanation of this occurrence
+	Instance string       `json:"instance,omitempty"` // Path of the request that failed
+	Errors   []FieldError `json:"errors,omitempty"`   // Validation errors of single fields
+
+	RetryAfter time.Duration `json:"-"` // Sent as the Retry-After header if set
+}
+
+// FieldError describes why one field of a payload is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error implements error
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// NewProblem creates a problem of the plain HTTP status kind
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// ValidationProblem creates a 422 problem listing the invalid fields
+func ValidationProblem(errs []FieldError) *Problem {
+	return &Problem{
+		Type:   problemValidation,
+		Title:  "Validation failed",
+		Status: http.StatusUnprocessableEntity,
+		Detail: strconv.Itoa(len(errs)) + " field(s) are invalid",
+		Errors: errs,
+	}
+}
+
+// unknownFieldPrefix starts the error of a decoder with DisallowUnknownFields set
+const unknownFieldPrefix = "json: unknown field "
+
+// DecodeProblem turns an error of the JSON decoder into a 400 problem without
+// exposing the decoder's internals. Bodies cut off by http.MaxBytesReader give 413.
+func DecodeProblem(err error) *Problem {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return NewProblem(http.StatusRequestEntityTooLarge, "The request body is larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+	}
+
+	p := &Problem{
+		Type:   problemMalformed,
+		Title:  "Malformed request body",
+		Status: http.StatusBadRequest,
+		Detail: "The request body is not valid JSON",
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		p.Detail = "The request body is empty"
+	case errors.As(err, &typeErr):
+		p.Detail = "A field has the wrong type"
+		p.Errors = []FieldError{{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String()}}
+	case errors.As(err, &syntaxErr):
+		p.Detail = "The request body is not valid JSON at offset " + strconv.FormatInt(syntaxErr.Offset, 10)
+	case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+		// Returned with DisallowUnknownFields, the decoder has no error type for it
+		p.Detail = "The request body has an unknown field"
+		p.Errors = []FieldError{{Field: strings.Trim(strings.TrimPrefix(err.Error(), unknownFieldPrefix), `"`), Message: "is not a known field"}}
+	}
+	return p
+}
+
+// WriteProblem sends p as application/problem+json
+func WriteProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	p.writeHeaders(w)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeHeaders sends the headers both error formats share and the status
+func (p *Problem) writeHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if p.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(p.RetryAfter.Seconds()))))
+	}
+	w.WriteHeader(p.Status)
+}
+
+// errorPage renders problems for the browser routes
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Status}} {{.Title}}</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            background-color: #f4f4f4;
+            color: #333;
+            text-align: center;
+            padding: 50px;
+        }
+        .container {
+            background-color: white;
+            padding: 30px;
+            border-radius: 10px;
+            box-shadow: 0 0 20px rgba(0, 0, 0, 0.1);
+            max-width: 500px;
+            margin: 0 auto;
+        }
+        h1 {
+            color: #d9534f;
+        }
+        ul {
+            text-align: left;
+        }
+        .button {
+            background-color: #4CAF50;
+            color: white;
+            padding: 10px 24px;
+            text-decoration: none;
+            border-radius: 4px;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Status}} {{.Title}}</h1>
+        {{if .Detail}}<p>{{.Detail}}</p>{{end}}
+        {{if .Errors}}<ul>{{range .Errors}}<li><strong>{{.Field}}</strong>: {{.Message}}</li>{{end}}</ul>{{end}}
+        <p><a href="/" class="button">Back to the homepage</a></p>
+    </div>
+</body>
+</html>`))
+
+// WriteHTMLError sends p as an HTML error page, for routes used from a browser
+func WriteHTMLError(w http.ResponseWriter, p *Problem) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	p.writeHeaders(w)
+	errorPage.Execute(w, p)
+}
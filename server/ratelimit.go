@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: it refills at Rate tokens per second and
+// holds at most Burst tokens.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Bucket names a token bucket and the limit it is checked against
+type Bucket struct {
+	Key   string
+	Limit RateLimit
+}
+
+// LimiterStore keeps token bucket state. It is an interface so the buckets can
+// live in memory for a single instance or in the database when several instances
+// have to share them.
+type LimiterStore interface {
+	// Take removes one token from each of the buckets, but only if every one of them
+	// has a token available, so a rejected call costs nothing. It reports whether the
+	// tokens were taken and, if not, how long the caller has to wait for them.
+	Take(buckets ...Bucket) (bool, time.Duration, error)
+}
+
+// takeTokens applies the token bucket algorithm to stored buckets. It refills each
+// bucket for the time passed since its last update and removes one token from all of
+// them if every bucket has one. It returns the new token counts, whether the tokens
+// were taken and, if not, the wait until all buckets have a token again.
+func takeTokens(tokens []float64, last []time.Time, now time.Time, buckets []Bucket) ([]float64, bool, time.Duration) {
+	next := make([]float64, len(buckets))
+	allowed := true
+	var wait time.Duration
+	for i, b := range buckets {
+		next[i] = math.Min(float64(b.Limit.Burst), tokens[i]+now.Sub(last[i]).Seconds()*b.Limit.Rate)
+		if next[i] < 1 {
+			allowed = false
+			if w := time.Duration((1 - next[i]) / b.Limit.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	if !allowed {
+		return next, false, wait
+	}
+	for i := range next {
+		next[i]--
+	}
+	return next, true, 0
+}
+
+// MemoryLimiterStore is a LimiterStore for a single server instance.
+type MemoryLimiterStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket is the state of one token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryLimiterStore creates an empty MemoryLimiterStore
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{buckets: make(map[string]*bucket)}
+}
+
+// Take implements LimiterStore
+func (s *MemoryLimiterStore) Take(buckets ...Bucket) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tokens := make([]float64, len(buckets))
+	last := make([]time.Time, len(buckets))
+	for i, bk := range buckets {
+		b, ok := s.buckets[bk.Key]
+		if !ok {
+			// New buckets start full
+			b = &bucket{tokens: float64(bk.Limit.Burst), last: now}
+			s.buckets[bk.Key] = b
+		}
+		tokens[i], last[i] = b.tokens, b.last
+	}
+
+	next, allowed, wait := takeTokens(tokens, last, now, buckets)
+	for i, bk := range buckets {
+		b := s.buckets[bk.Key]
+		b.tokens, b.last = next[i], now
+	}
+	return allowed, wait, nil
+}
+
+// SendLimiter limits how fast users can send chat messages, both overall and
+// within a single conversation (each participant has their own bucket there).
+type SendLimiter struct {
+	Store           LimiterStore
+	PerUser         RateLimit
+	PerConversation RateLimit
+	TrustedBurst    map[string]int       // Burst allowance per role, replacing the default burst
+	RoleLimits      map[string]RateLimit // Per-user limit replacing PerUser for a role
+}
+
+// sendLimiter guards all message sending endpoints
+var sendLimiter = NewSendLimiterFromEnv(NewMemoryLimiterStore())
+
+// NewSendLimiterFromEnv creates a SendLimiter with the default limits, overridden
+// by these environment variables if they are set:
+//
+//	SEND_LIMIT_PER_USER=1:10            tokens per second and burst for each sender
+//	SEND_LIMIT_PER_CONVERSATION=0.5:5   the same within one conversation
+//	SEND_LIMIT_BOT=2:20                 per sender limit of bots
+//	SEND_BURST_ADMIN=50                 burst allowance of admins
+//
+// Invalid values are reported and the default is kept.
+func NewSendLimiterFromEnv(store LimiterStore) *SendLimiter {
+	l := &SendLimiter{
+		Store:           store,
+		PerUser:         RateLimit{Rate: 1, Burst: 10},
+		PerConversation: RateLimit{Rate: 0.5, Burst: 5},
+		TrustedBurst:    map[string]int{"admin": 50},
+		RoleLimits:      map[string]RateLimit{"bot": {Rate: 2, Burst: 20}},
+	}
+
+	for name, target := range map[string]*RateLimit{"SEND_LIMIT_PER_USER": &l.PerUser, "SEND_LIMIT_PER_CONVERSATION": &l.PerConversation} {
+		if limit, ok := rateLimitFromEnv(name); ok {
+			*target = limit
+		}
+	}
+	if limit, ok := rateLimitFromEnv("SEND_LIMIT_BOT"); ok {
+		l.RoleLimits["bot"] = limit
+	}
+	if value := os.Getenv("SEND_BURST_ADMIN"); value != "" {
+		if burst, err := strconv.Atoi(value); err == nil && burst > 0 {
+			l.TrustedBurst["admin"] = burst
+		} else {
+			fmt.Println("Ignoring invalid SEND_BURST_ADMIN:", value)
+		}
+	}
+	return l
+}
+
+// rateLimitFromEnv reads a limit given as rate:burst from the environment variable name
+func rateLimitFromEnv(name string) (RateLimit, bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return RateLimit{}, false
+	}
+	rate, burst, _ := strings.Cut(value, ":")
+	r, errRate := strconv.ParseFloat(rate, 64)
+	b, errBurst := strconv.Atoi(burst)
+	if errRate != nil || errBurst != nil || r <= 0 || b < 1 {
+		fmt.Printf("Ignoring invalid %s: %q, expected rate:burst\n", name, value)
+		return RateLimit{}, false
+	}
+	return RateLimit{Rate: r, Burst: b}, true
+}
+
+// forRole returns limit with the burst raised for trusted roles
+func (l *SendLimiter) forRole(limit RateLimit, role string) RateLimit {
+	if burst, ok := l.TrustedBurst[role]; ok && burst > limit.Burst {
+		limit.Burst = burst
+	}
+	return limit
+}
+
+// Check checks whether senderID may send another message to receiverID on behalf
+// of request r. If not, it returns the 429 Too Many Requests problem for the caller
+// to send, as JSON or as a page; its RetryAfter becomes the Retry-After header. The
+// role is taken from the JWT of the request if it carries a valid one.
+func (l *SendLimiter) Check(r *http.Request, senderID, receiverID string) *Problem {
+	role := ""
+	if claims, err := ClaimsFromRequest(r); err == nil {
+		role = claims.Role
+	}
+	return l.CheckRole(senderID, receiverID, role)
+}
+
+// CheckRole is Check for senders acting with the given role, without a request
+func (l *SendLimiter) CheckRole(senderID, receiverID, role string) *Problem {
+	allowed, wait := l.Take(senderID, receiverID, role)
+	if allowed {
+		return nil
+	}
+	p := NewProblem(http.StatusTooManyRequests, fmt.Sprintf("Too many messages, retry in %s", wait.Round(time.Second)))
+	p.RetryAfter = wait
+	return p
+}
+
+// Take checks whether senderID, acting with the given role, may send another
+// message to receiverID. If not, it returns how long the sender has to wait.
+func (l *SendLimiter) Take(senderID, receiverID, role string) (bool, time.Duration) {
+	perUser, ok := l.RoleLimits[role]
+	if !ok {
+		perUser = l.forRole(l.PerUser, role)
+	}
+	userKey := "user:" + senderID
+	if role == "bot" {
+		// Bots answer everyone, so one user talking to a bot must not use up its replies to all others
+		userKey = "bot:" + senderID + ":" + receiverID
+	}
+
+	allowed, wait, err := l.Store.Take(
+		Bucket{Key: userKey, Limit: perUser},
+		Bucket{Key: "conversation:" + ConversationID(senderID, receiverID) + ":" + senderID, Limit: l.forRole(l.PerConversation, role)},
+	)
+	if err != nil {
+		// Don't lock everybody out because the limiter store is unavailable
+		fmt.Println("Rate limiter error:", err)
+		return true, 0
+	}
+	return allowed, wait
+}
@@ -1,78 +1,127 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var (
-	// Map to store users with their ID as the key
-	users = make(map[string]User)
-)
-
 /**
  * Implementing CRUD (Create, Read, Update, Delete) operations for user management.
- * This simulates a RESTful API for handling users.
+ * The users live in the shared `userRepo`, so they are the same users the chat and the pages see.
  */
 
 /**
- * GetUsers handles the HTTP GET request for retrieving all users.
- * It locks the mutex to ensure thread safety while accessing the shared `users` map.
- * Responds with a JSON-encoded list of all users.
+ * GetUsers handles the HTTP GET request for listing users.
+ * Responds with a JSON-encoded list of one page of users. The query string selects
+ * filters, sort order and the page (see ParseUserQuery); the total number of matching
+ * users is sent in the X-Total-Count header, links to other pages in the Link header and
+ * the cursor of the next page in the X-Next-Cursor header. The page carries an ETag, a
+ * matching If-None-Match header is answered with 304 Not Modified.
  *
  * @param w http.ResponseWriter: The response writer to send data to the client.
  * @param r *http.Request: The incoming HTTP request.
  */
 func GetUsers(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
+	query, err := ParseUserQuery(r.URL.Query())
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	stored, err := userRepo.List()
+	if err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
+	all := make([]User, 0, len(stored))
+	for _, user := range stored {
+		all = append(all, user.InternData)
+	}
 
+	page, total, next := query.Apply(all)
+	body, _ := json.Marshal(page)
+	if notModified(w, r, contentETag(body, strconv.Itoa(total), next)) {
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	if links := query.Links(r.URL, total, next); links != "" {
+		w.Header().Add("Link", links)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	w.Write(append(body, '\n'))
 }
 
 /**
  * CreateUser handles the HTTP POST request for creating a new user.
- * It locks the mutex to ensure thread safety while modifying the `users` map.
- * The user data is decoded from the request body and added to the `users` map.
- * Responds with a status code 201 Created if successful.
+ * The user data is decoded from the request body and added to the repository under a new ID
+ * assigned by the server; a client chosen ID is rejected.
+ * Users created here have no password, so they can't log in until one is set.
+ * Responds with a status code 201 Created, the new user and its URL in the Location header
+ * if successful, or 409 if the name is taken.
  *
  * @param w http.ResponseWriter: The response writer to send data to the client.
  * @param r *http.Request: The incoming HTTP request.
  */
 func CreateUser(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if user.ID != "" {
+		WriteProblem(w, r, ValidationProblem([]FieldError{{Field: "id", Message: "is assigned by the server"}}))
+		return
+	}
+	user.ID = NewID()
+	if errs := Validate(user); errs != nil {
+		WriteProblem(w, r, ValidationProblem(errs))
 		return
 	}
 
-	users[user.ID] = user
-	defer mu.Unlock()
+	user.Name = strings.TrimSpace(user.Name)
+	user.CreatedAt = time.Now()
+	user.Version = 1
+	if err := userRepo.Create(ChatUser{InternData: user, Role: "user"}); err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
 
+	w.Header().Set("ETag", UserETag(user))
+	w.Header().Set("Location", apiV1Prefix+"/users/"+user.ID)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
 }
 
 /**
  * GetUser handles the HTTP GET request for retrieving a specific user by ID.
- * It locks the mutex to ensure thread safety while accessing the `users` map.
  * Responds with a JSON-encoded user object if found, or a 404 Not Found status if the user does not exist.
+ * The user's ETag is sent along, a matching If-None-Match header is answered with 304 Not Modified.
  *
  * @param w http.ResponseWriter: The response writer to send data to the client.
  * @param r *http.Request: The incoming HTTP request.
  */
 func GetUser(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	id := mux.Vars(r)["id"]
-	user, exists := users[id]
-	if !exists {
-		http.Error(w, "User not found", http.StatusNotFound)
+	stored, err := userRepo.Get(mux.Vars(r)["id"])
+	if err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
+	user := stored.InternData
+	if notModified(w, r, UserETag(user)) {
 		return
 	}
 
@@ -81,72 +130,329 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 }
 
 /**
- * UpdateUser handles the HTTP PUT request for updating a specific user's information.
- * It locks the mutex to ensure thread safety while modifying the `users` map.
- * The updated user data is decoded from the request body and the existing user is updated.
- * Responds with the updated user object if successful, or a 404 Not Found status if the user does not exist.
+ * UpdateUser handles the HTTP PUT request for replacing a specific user.
+ * The body is the complete new user document; an omitted ID defaults to the one in the path.
+ * Responds with the updated user object if successful, 400 if the document is invalid,
+ * or a 404 Not Found status if the user does not exist.
+ * The If-Match header must carry the user's current ETag: 428 if it is missing, 412 if it
+ * doesn't match because someone else changed the user in between.
  *
  * @param w http.ResponseWriter: The response writer to send data to the client.
  * @param r *http.Request: The incoming HTTP request.
  */
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-
 	id := mux.Vars(r)["id"]
-	user, exists := users[id]
-	if !exists {
-		http.Error(w, "User not found", http.StatusNotFound)
+	stored, err := userRepo.Get(id)
+	if err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
+	if !checkIfMatch(w, r, UserETag(stored.InternData)) {
 		return
 	}
 
-	var updatedUser User
-	if err := json.NewDecoder(r.Body).Decode(&updatedUser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "The request body could not be read"))
 		return
 	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil {
+		if _, hasID := fields["id"]; !hasID {
+			fields["id"], _ = json.Marshal(id)
+			body, _ = json.Marshal(fields)
+		}
+	}
 
-	// Update the user's name in the map
-	user.Name = updatedUser.Name
-	users[id] = user
-	mu.Unlock()
+	user, problem := decodeUser(body, stored.InternData)
+	if problem != nil {
+		WriteProblem(w, r, problem)
+		return
+	}
+	saveUser(w, r, stored, user)
+}
+
+/**
+ * PatchUser handles the HTTP PATCH request for partially updating a specific user.
+ * The body is either an RFC 7396 JSON Merge Patch (Content-Type application/merge-patch+json)
+ * or an RFC 6902 JSON Patch (Content-Type application/json-patch+json), applied to the
+ * user's JSON representation. The resulting document is validated like a PUT body.
+ * Responds with the updated user object if successful, 400 if the patch can't be applied
+ * or the result is invalid, 404 if the user does not exist, or 415 for other content types.
+ * If-Match is required like for UpdateUser.
+ *
+ * @param w http.ResponseWriter: The response writer to send data to the client.
+ * @param r *http.Request: The incoming HTTP request.
+ */
+func PatchUser(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var apply func(doc, patch []byte) ([]byte, error)
+	switch mediaType {
+	case mergePatchType:
+		apply = MergePatch
+	case jsonPatchType:
+		apply = JSONPatch
+	default:
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		WriteProblem(w, r, NewProblem(http.StatusUnsupportedMediaType, "Unsupported patch format, use "+mergePatchType+" or "+jsonPatchType))
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "The request body could not be read"))
+		return
+	}
+
+	stored, err := userRepo.Get(mux.Vars(r)["id"])
+	if err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
+	if !checkIfMatch(w, r, UserETag(stored.InternData)) {
+		return
+	}
+
+	doc, _ := json.Marshal(stored.InternData)
+	patched, err := apply(doc, patch)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "Patch could not be applied: "+err.Error()))
+		return
+	}
+	user, problem := decodeUser(patched, stored.InternData)
+	if problem != nil {
+		WriteProblem(w, r, problem)
+		return
+	}
+	saveUser(w, r, stored, user)
+}
+
+/**
+ * saveUser stores the new user data of a PUT or PATCH and responds with the user.
+ * Password and role of the stored user are kept.
+ *
+ * @param stored ChatUser: The user as it was read before the update.
+ * @param user User: The new, validated user data.
+ */
+func saveUser(w http.ResponseWriter, r *http.Request, stored ChatUser, user User) {
+	version := stored.InternData.Version
+	stored.InternData = user
+	if err := userRepo.Update(stored, version); err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
+
+	w.Header().Set("ETag", UserETag(user))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
+/**
+ * decodeUser decodes and validates a complete user document replacing current.
+ * Unknown members are rejected, the ID can't be changed, created_at is kept and the
+ * version is incremented. Returns a problem describing why the document is invalid.
+ *
+ * @param doc []byte: The JSON user document.
+ * @param current User: The user being updated.
+ */
+func decodeUser(doc []byte, current User) (User, *Problem) {
+	var user User
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&user); err != nil {
+		return User{}, DecodeProblem(err)
+	}
+
+	if user.ID != current.ID {
+		return User{}, ValidationProblem([]FieldError{{Field: "id", Message: "can't be changed"}})
+	}
+	if errs := Validate(user); errs != nil {
+		return User{}, ValidationProblem(errs)
+	}
+	user.Name = strings.TrimSpace(user.Name)
+	user.CreatedAt = current.CreatedAt
+	user.Version = current.Version + 1
+	return user, nil
+}
+
+/**
+ * repoProblem turns an error of the user repository into the matching problem.
+ *
+ * @param err error: The error returned by userRepo.
+ */
+func repoProblem(err error) *Problem {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return NewProblem(http.StatusNotFound, "User not found")
+	case errors.Is(err, ErrUserExists):
+		return NewProblem(http.StatusConflict, "A user with this id already exists")
+	case errors.Is(err, ErrNameTaken):
+		p := NewProblem(http.StatusConflict, "This name is already taken")
+		p.Errors = []FieldError{{Field: "name", Message: "is already taken"}}
+		return p
+	case errors.Is(err, ErrVersionConflict):
+		return NewProblem(http.StatusPreconditionFailed, "The resource was changed by someone else, fetch it again")
+	}
+	fmt.Println("User repository error:", err)
+	return NewProblem(http.StatusInternalServerError, "The users could not be accessed")
+}
+
+/**
+ * IsAdminOrSelf only lets a request through if its JWT belongs to an admin or to the
+ * user named by the {id} path variable.
+ *
+ * @param next http.Handler: The handler to protect.
+ */
+func IsAdminOrSelf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := ClaimsFromRequest(r)
+		if err != nil {
+			WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "A valid JWT is required in the Authorization header"))
+			return
+		}
+
+		if claims.Role != "admin" {
+			user, err := userRepo.Get(mux.Vars(r)["id"])
+			if err != nil || !strings.EqualFold(user.InternData.Name, claims.Username) {
+				WriteProblem(w, r, NewProblem(http.StatusForbidden, "Only admins can change other users"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * ReplaceUser replaces a user outside of an HTTP request, for the GraphQL and gRPC APIs.
+ * It applies the rules of IsAdminOrSelf and UpdateUser: claims must belong to an admin or
+ * to the user, user.Version must be the current version and the new data must be valid.
+ * Errors are problems carrying the status the HTTP API would answer with.
+ *
+ * @param claims *Claims: The JWT claims of the caller, nil if there are none.
+ * @param user User: The new user data with the version it is based on.
+ */
+func ReplaceUser(claims *Claims, user User) (User, error) {
+	if claims == nil {
+		return User{}, NewProblem(http.StatusUnauthorized, "A valid JWT is required")
+	}
+	stored, err := userRepo.Get(user.ID)
+	if err != nil {
+		return User{}, repoProblem(err)
+	}
+	if claims.Role != "admin" && !strings.EqualFold(stored.InternData.Name, claims.Username) {
+		return User{}, NewProblem(http.StatusForbidden, "Only admins can change other users")
+	}
+	version := stored.InternData.Version
+	if user.Version != version {
+		return User{}, repoProblem(ErrVersionConflict)
+	}
+
+	doc, _ := json.Marshal(User{ID: user.ID, Name: user.Name})
+	updated, problem := decodeUser(doc, stored.InternData)
+	if problem != nil {
+		return User{}, problem
+	}
+	stored.InternData = updated
+	if err := userRepo.Update(stored, version); err != nil {
+		return User{}, repoProblem(err)
+	}
+	return updated, nil
+}
+
 /**
  * DeleteUser handles the HTTP DELETE request for deleting a specific user by ID.
- * It locks the mutex to ensure thread safety while modifying the `users` map.
- * The user is removed from the `users` map.
+ * The user is removed from the repository.
  * Responds with a status code 204 No Content if successful, or a 404 Not Found status if the user does not exist.
+ * If-Match is required like for UpdateUser.
  *
  * @param w http.ResponseWriter: The response writer to send data to the client.
  * @param r *http.Request: The incoming HTTP request.
  */
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-
 	id := mux.Vars(r)["id"]
-	if _, exists := users[id]; !exists {
-		http.Error(w, "User not found", http.StatusNotFound)
+	stored, err := userRepo.Get(id)
+	if err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
+	if !checkIfMatch(w, r, UserETag(stored.InternData)) {
 		return
 	}
 
-	delete(users, id)
-	defer mu.Unlock()
+	if err := userRepo.Delete(id); err != nil {
+		WriteProblem(w, r, repoProblem(err))
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// LoginRequest is the body of POST /api/v1/login.
+type LoginRequest struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// LoginResponse carries the JWT for the Authorization header of later requests.
+type LoginResponse struct {
+	Token string `json:"token"`
+}
+
+/**
+ * IssueToken handles the HTTP POST request for logging in from API clients.
+ * The name and password are checked against the stored user, who gets a JWT with their
+ * stored role in return. Users without a password, like bots, can't log in.
+ * Responds with 200 OK and the token, or 401 if the name or password is wrong.
+ * The login form of the pages stays at /restful/login.
+ *
+ * @param w http.ResponseWriter: The response writer to send data to the client.
+ * @param r *http.Request: The incoming HTTP request.
+ */
+func IssueToken(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if errs := Validate(req); errs != nil {
+		WriteProblem(w, r, ValidationProblem(errs))
+		return
+	}
+
+	user, err := userRepo.GetByName(req.Name)
+	if err != nil || !CheckPassword(user, req.Password) {
+		WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "Invalid name or password"))
+		return
+	}
+	token, err := GenerateJWT(user.InternData.Name, user.Role)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error creating the token"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(LoginResponse{Token: token})
+}
+
 /**
  * RegisterRoutes sets up the routing for the user management API.
- * It registers the CRUD operations with specific HTTP methods and paths.
+ * It registers the CRUD operations with specific HTTP methods and paths under /api/v1.
  *
- * @param r *mux.Router: The router to which routes are added.
+ * @param api *API: The API to which routes are added.
  */
-func RegisterRoutes(r *mux.Router) {
-	r.HandleFunc("/users", GetUsers).Methods("GET")            // Route for listing all users (accessible by all)
-	r.HandleFunc("/users/{id:[0-9]+}", GetUser).Methods("GET") // Route for retrieving a user by ID (accessible by all)
+func RegisterRoutes(api *API) {
+	userPath := "/users/{id:" + idPattern + "}" // ULIDs and the numeric IDs of older users
+
+	api.HandleFunc("GET", "/users", GetUsers) // Route for listing all users (accessible by all)
+	api.HandleFunc("GET", userPath, GetUser)  // Route for retrieving a user by ID (accessible by all)
+
+	api.Handle("POST", "/users", IsAdmin(http.HandlerFunc(CreateUser)))   // Route for creating a new user (admin only)
+	api.Handle("DELETE", userPath, IsAdmin(http.HandlerFunc(DeleteUser))) // Route for deleting a user by ID (admin only)
+
+	api.Handle("PUT", userPath, IsAdminOrSelf(http.HandlerFunc(UpdateUser)))  // Route for replacing a user (admin or the user themselves)
+	api.Handle("PATCH", userPath, IsAdminOrSelf(http.HandlerFunc(PatchUser))) // Route for patching a user (admin or the user themselves)
 
-	r.Handle("/users", IsAdmin(http.HandlerFunc(CreateUser))).Methods("POST")               // Route for creating a new user (admin only)
-	r.Handle("/users/{id:[0-9]+}", IsAdmin(http.HandlerFunc(DeleteUser))).Methods("DELETE") // Route for deleting a user by ID (admin only)
+	api.HandleV1("POST", "/login", http.HandlerFunc(IssueToken)) // Route for getting a JWT (accessible by all)
 }
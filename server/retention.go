@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RetentionPolicy decides how long messages are kept. A global maximum age
+// applies to all messages, conversations can set a shorter disappearing-message
+// timer, and users under legal hold are exempt from both.
+type RetentionPolicy struct {
+	mu     sync.Mutex
+	maxAge time.Duration            // Global maximum age, 0 keeps messages forever
+	timers map[string]time.Duration // Conversation ID -> disappearing-message timer
+	holds  map[string]LegalHold     // User ID -> legal hold
+}
+
+// LegalHold exempts all messages sent or received by a user from deletion.
+type LegalHold struct {
+	UserID   string
+	Reason   string
+	PlacedBy string // Name of the admin who placed the hold
+	PlacedAt time.Time
+}
+
+// NewRetentionPolicy creates a policy with the given global maximum age
+func NewRetentionPolicy(maxAge time.Duration) *RetentionPolicy {
+	return &RetentionPolicy{
+		maxAge: maxAge,
+		timers: make(map[string]time.Duration),
+		holds:  make(map[string]LegalHold),
+	}
+}
+
+// retention is the policy applied to the messages of the chat service.
+// Messages are kept forever unless RETENTION_MAX_AGE or an admin sets a maximum age.
+var retention = NewRetentionPolicy(maxAgeFromEnv())
+
+// maxAgeFromEnv reads the global maximum age from RETENTION_MAX_AGE, a duration
+// like 2160h. It returns 0 if the variable is unset or invalid.
+func maxAgeFromEnv() time.Duration {
+	value := os.Getenv("RETENTION_MAX_AGE")
+	if value == "" {
+		return 0
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge < 0 {
+		fmt.Println("Ignoring invalid RETENTION_MAX_AGE:", value)
+		return 0
+	}
+	return maxAge
+}
+
+// SetMaxAge changes the global maximum age, 0 disables it
+func (p *RetentionPolicy) SetMaxAge(maxAge time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxAge = maxAge
+}
+
+// SetTimer sets the disappearing-message timer of a conversation, 0 removes it
+func (p *RetentionPolicy) SetTimer(conversationID string, timer time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if timer <= 0 {
+		delete(p.timers, conversationID)
+		return
+	}
+	p.timers[conversationID] = timer
+}
+
+// PlaceHold puts a user under legal hold
+func (p *RetentionPolicy) PlaceHold(hold LegalHold) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.holds[hold.UserID] = hold
+}
+
+// ReleaseHold lifts the legal hold of a user. Returns false if there was none.
+func (p *RetentionPolicy) ReleaseHold(userID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.holds[userID]; !ok {
+		return false
+	}
+	delete(p.holds, userID)
+	return true
+}
+
+// Holds returns all legal holds currently in place
+func (p *RetentionPolicy) Holds() []LegalHold {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	holds := make([]LegalHold, 0, len(p.holds))
+	for _, hold := range p.holds {
+		holds = append(holds, hold)
+	}
+	return holds
+}
+
+// Expired reports whether msg should be deleted at the given time
+func (p *RetentionPolicy) Expired(msg Message, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, held := p.holds[msg.SenderID]; held {
+		return false
+	}
+	if _, held := p.holds[msg.ReceiverID]; held {
+		return false
+	}
+
+	age := now.Sub(msg.TimeStamp)
+	if p.maxAge > 0 && age > p.maxAge {
+		return true
+	}
+	timer, ok := p.timers[ConversationID(msg.SenderID, msg.ReceiverID)]
+	return ok && age > timer
+}
+
+// PurgeExpired removes all expired messages from the chat service and returns how many were removed
+func (cs *ChatService) PurgeExpired(policy *RetentionPolicy) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	kept := cs.messages[:0]
+	for _, msg := range cs.messages {
+		if !policy.Expired(msg, now) {
+			kept = append(kept, msg)
+		}
+	}
+	purged := len(cs.messages) - len(kept)
+	cs.messages = kept
+	if purged > 0 {
+		cs.reindex()
+	}
+	return purged
+}
+
+// StartRetentionSweeper purges expired messages from the chat service every
+// interval until stop is closed. The rows of the messages table are not purged:
+// timers and legal holds only live in memory, and a restarted or second instance
+// would delete rows that are held.
+func (cs *ChatService) StartRetentionSweeper(policy *RetentionPolicy, interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if n := cs.PurgeExpired(policy); n > 0 {
+					fmt.Printf("Retention sweeper purged %d chat messages\n", n)
+				}
+			}
+		}
+	}()
+}
+
+// HTTP Handlers
+
+// SetTimerHandler sets the disappearing-message timer of a conversation.
+// Only the two participants of the conversation may change it.
+func (cs *ChatService) SetTimerHandler(w http.ResponseWriter, r *http.Request) {
+	userA, userB, ok := strings.Cut(mux.Vars(r)["id"], ":")
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "Conversation ID must look like user1:user2"))
+		return
+	}
+	if !cs.isSelf(r, userA) && !cs.isSelf(r, userB) {
+		WriteProblem(w, r, NewProblem(http.StatusForbidden, "Only participants can change the timer"))
+		return
+	}
+
+	var req struct {
+		Seconds int64 // 0 turns disappearing messages off
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if req.Seconds < 0 {
+		WriteProblem(w, r, ValidationProblem([]FieldError{{Field: "Seconds", Message: "must not be negative"}}))
+		return
+	}
+
+	retention.SetTimer(ConversationID(userA, userB), time.Duration(req.Seconds)*time.Second)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetRetentionHandler changes the global maximum message age (admin only)
+func SetRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxAgeSeconds int64 // 0 keeps messages forever
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if req.MaxAgeSeconds < 0 {
+		WriteProblem(w, r, ValidationProblem([]FieldError{{Field: "MaxAgeSeconds", Message: "must not be negative"}}))
+		return
+	}
+
+	retention.SetMaxAge(time.Duration(req.MaxAgeSeconds) * time.Second)
+	audit(r, "set_retention", "", (time.Duration(req.MaxAgeSeconds) * time.Second).String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHoldsHandler lists all legal holds (admin only)
+func GetHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retention.Holds())
+}
+
+// PlaceHoldHandler puts a user under legal hold (admin only)
+func PlaceHoldHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+
+	admin := ""
+	if claims, err := ClaimsFromRequest(r); err == nil {
+		admin = claims.Username
+	}
+
+	retention.PlaceHold(LegalHold{
+		UserID:   mux.Vars(r)["id"],
+		Reason:   req.Reason,
+		PlacedBy: admin,
+		PlacedAt: time.Now(),
+	})
+	audit(r, "place_hold", mux.Vars(r)["id"], req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReleaseHoldHandler lifts the legal hold of a user (admin only)
+func ReleaseHoldHandler(w http.ResponseWriter, r *http.Request) {
+	if !retention.ReleaseHold(mux.Vars(r)["id"]) {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Legal hold not found"))
+		return
+	}
+	audit(r, "release_hold", mux.Vars(r)["id"], "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ScheduledMessage is a message waiting to be sent at SendAt.
+type ScheduledMessage struct {
+	ID        string
+	Message   Message
+	SendAt    time.Time `json:"send_at"`
+	CreatedAt time.Time
+
+	ClaimedUntil time.Time `json:"-"` // Set while a scheduler is delivering the message
+	Attempts     int       `json:"-"` // Number of times delivery was started
+}
+
+// scheduleClaim is how long a scheduler may take to deliver a claimed message. If it
+// fails or crashes, the message is due again after this time.
+const scheduleClaim = time.Minute
+
+// maxDeliveryAttempts is how often delivery of a scheduled message is tried before it is dropped
+const maxDeliveryAttempts = 5
+
+// ScheduleStore keeps scheduled messages. The SQL implementation lets pending
+// messages survive restarts and be shared by several instances.
+type ScheduleStore interface {
+	Save(sm ScheduledMessage) error
+	// Update replaces the content and send time of a scheduled message unless delivery
+	// has started, i.e. it is claimed at now. It reports whether it was still pending.
+	Update(sm ScheduledMessage, now time.Time) (bool, error)
+	Get(id string) (ScheduledMessage, bool, error)
+	// Cancel removes a scheduled message unless delivery has started and reports
+	// whether it was still pending.
+	Cancel(id string, now time.Time) (bool, error)
+	// Delete removes a scheduled message and reports whether it was still there.
+	Delete(id string) (bool, error)
+	// Claim reserves a due message for delivery until the given time and reports whether
+	// this caller got it. Only the caller that claimed a message may deliver it. A claimed
+	// message isn't due again before the claim runs out, and counts one more attempt.
+	Claim(id string, now, until time.Time) (bool, error)
+	// Due returns the messages whose send time has come and which aren't claimed.
+	Due(now time.Time) ([]ScheduledMessage, error)
+	BySender(senderID string) ([]ScheduledMessage, error)
+}
+
+// MemoryScheduleStore is a ScheduleStore that forgets everything on restart.
+type MemoryScheduleStore struct {
+	mu    sync.Mutex
+	items map[string]ScheduledMessage
+}
+
+// NewMemoryScheduleStore creates an empty MemoryScheduleStore
+func NewMemoryScheduleStore() *MemoryScheduleStore {
+	return &MemoryScheduleStore{items: make(map[string]ScheduledMessage)}
+}
+
+// Save implements ScheduleStore
+func (s *MemoryScheduleStore) Save(sm ScheduledMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[sm.ID] = sm
+	return nil
+}
+
+// Update implements ScheduleStore
+func (s *MemoryScheduleStore) Update(sm ScheduledMessage, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.items[sm.ID]
+	if !ok || current.ClaimedUntil.After(now) {
+		return false, nil
+	}
+	current.Message = sm.Message
+	current.SendAt = sm.SendAt
+	s.items[sm.ID] = current
+	return true, nil
+}
+
+// Get implements ScheduleStore
+func (s *MemoryScheduleStore) Get(id string) (ScheduledMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sm, ok := s.items[id]
+	return sm, ok, nil
+}
+
+// Cancel implements ScheduleStore
+func (s *MemoryScheduleStore) Cancel(id string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sm, ok := s.items[id]
+	if !ok || sm.ClaimedUntil.After(now) {
+		return false, nil
+	}
+	delete(s.items, id)
+	return true, nil
+}
+
+// Delete implements ScheduleStore
+func (s *MemoryScheduleStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[id]; !ok {
+		return false, nil
+	}
+	delete(s.items, id)
+	return true, nil
+}
+
+// Claim implements ScheduleStore
+func (s *MemoryScheduleStore) Claim(id string, now, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sm, ok := s.items[id]
+	if !ok || sm.ClaimedUntil.After(now) {
+		return false, nil
+	}
+	sm.ClaimedUntil = until
+	sm.Attempts++
+	s.items[id] = sm
+	return true, nil
+}
+
+// Due implements ScheduleStore
+func (s *MemoryScheduleStore) Due(now time.Time) ([]ScheduledMessage, error) {
+	return s.filter(func(sm ScheduledMessage) bool { return !sm.SendAt.After(now) && !sm.ClaimedUntil.After(now) }), nil
+}
+
+// BySender implements ScheduleStore
+func (s *MemoryScheduleStore) BySender(senderID string) ([]ScheduledMessage, error) {
+	return s.filter(func(sm ScheduledMessage) bool { return sm.Message.SenderID == senderID }), nil
+}
+
+// filter returns the matching scheduled messages ordered by SendAt
+func (s *MemoryScheduleStore) filter(match func(ScheduledMessage) bool) []ScheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []ScheduledMessage
+	for _, sm := range s.items {
+		if match(sm) {
+			list = append(list, sm)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SendAt.Before(list[j].SendAt) })
+	return list
+}
+
+// Scheduler delivers scheduled messages through the ChatService once they are due.
+type Scheduler struct {
+	cs    *ChatService
+	store ScheduleStore
+}
+
+// NewScheduler creates a Scheduler delivering into cs
+func NewScheduler(cs *ChatService, store ScheduleStore) *Scheduler {
+	return &Scheduler{cs: cs, store: store}
+}
+
+// Schedule queues msg to be sent at sendAt
+func (s *Scheduler) Schedule(msg Message, sendAt time.Time) (ScheduledMessage, error) {
+	sm := ScheduledMessage{
+		ID:        NewID(),
+		Message:   msg,
+		SendAt:    sendAt,
+		CreatedAt: time.Now(),
+	}
+	return sm, s.store.Save(sm)
+}
+
+// deliver sends a due message. Moderation runs now rather than when the message
+// was scheduled, since the content can be edited in between. The server can't read
+// encrypted messages, so they skip moderation like in SendMessageHandler.
+func (s *Scheduler) deliver(sm ScheduledMessage) error {
+	if sm.Message.IsEncrypted() {
+		return s.cs.Deliver(sm.Message)
+	}
+	return s.cs.SendModerated(sm.Message)
+}
+
+// RunDue delivers every message that is due. A message is claimed before and only
+// removed after its delivery, so a crash in between delivers it again rather than
+// losing it. Failed deliveries are retried once the claim runs out, up to
+// maxDeliveryAttempts times.
+func (s *Scheduler) RunDue() {
+	now := time.Now()
+	due, err := s.store.Due(now)
+	if err != nil {
+		fmt.Println("Scheduler failed:", err)
+		return
+	}
+
+	for _, sm := range due {
+		claimed, err := s.store.Claim(sm.ID, now, now.Add(scheduleClaim))
+		if err != nil {
+			fmt.Println("Scheduler failed:", err)
+			continue
+		}
+		// Another instance or a cancel got there first
+		if !claimed {
+			continue
+		}
+
+		if err := s.deliver(sm); err != nil {
+			if sm.Attempts+1 < maxDeliveryAttempts {
+				fmt.Printf("Scheduled message %s could not be delivered, retrying in %s: %s\n", sm.ID, scheduleClaim, err)
+				continue
+			}
+			fmt.Printf("Scheduled message %s could not be delivered, giving up: %s\n", sm.ID, err)
+		}
+		if _, err := s.store.Delete(sm.ID); err != nil {
+			fmt.Println("Scheduler failed:", err)
+		}
+	}
+}
+
+// Start checks for due messages every interval until stop is closed.
+// Messages that became due while the server was down are sent on the first tick.
+func (s *Scheduler) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.RunDue()
+			}
+		}
+	}()
+}
+
+// HTTP Handlers
+
+// ownScheduled loads a scheduled message and checks that it belongs to the caller
+func (s *Scheduler) ownScheduled(w http.ResponseWriter, r *http.Request) (ScheduledMessage, bool) {
+	sm, found, err := s.store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error loading scheduled message"))
+		return sm, false
+	}
+	if !found {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Scheduled message not found"))
+		return sm, false
+	}
+	if !s.cs.isSelf(r, sm.Message.SenderID) {
+		WriteProblem(w, r, NewProblem(http.StatusForbidden, "Not your scheduled message"))
+		return sm, false
+	}
+	return sm, true
+}
+
+// ListScheduledHandler lists the pending scheduled messages of the calling user
+func (s *Scheduler) ListScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.cs.callerID(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := s.store.BySender(userID)
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error loading scheduled messages"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// EditScheduledHandler changes the content and/or send time of a pending message.
+// Once delivery has started the message can't be changed anymore.
+func (s *Scheduler) EditScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.ownScheduled(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Message *string
+		SendAt  *time.Time `json:"send_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteProblem(w, r, DecodeProblem(err))
+		return
+	}
+	if req.Message != nil {
+		if sm.Message.IsEncrypted() {
+			WriteProblem(w, r, NewProblem(http.StatusBadRequest, "Encrypted messages must not carry plaintext content"))
+			return
+		}
+		sm.Message.Message = *req.Message
+		if errs := messageSizeErrors(sm.Message); errs != nil {
+			WriteProblem(w, r, ValidationProblem(errs))
+			return
+		}
+	}
+	if req.SendAt != nil {
+		if !req.SendAt.After(time.Now()) {
+			WriteProblem(w, r, NewProblem(http.StatusBadRequest, "send_at must be in the future"))
+			return
+		}
+		sm.SendAt = *req.SendAt
+	}
+
+	updated, err := s.store.Update(sm, time.Now())
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error saving scheduled message"))
+		return
+	}
+	if !updated {
+		WriteProblem(w, r, NewProblem(http.StatusConflict, "Scheduled message is already being sent"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sm)
+}
+
+// CancelScheduledHandler cancels a pending message, unless delivery has started
+func (s *Scheduler) CancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	sm, ok := s.ownScheduled(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.store.Cancel(sm.ID, time.Now())
+	if err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusInternalServerError, "Error cancelling scheduled message"))
+		return
+	}
+	if !deleted {
+		WriteProblem(w, r, NewProblem(http.StatusConflict, "Scheduled message is already being sent"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// findMessage returns the message with the given ID. The caller must hold cs.mu.
+func (cs *ChatService) findMessage(id string) (Message, bool) {
+	pos, ok := cs.byID[id]
+	if !ok {
+		return Message{}, false
+	}
+	return cs.messages[pos], true
+}
+
+// validateReply checks that a reply refers to an existing message of the same
+// conversation. The caller must hold cs.mu.
+func (cs *ChatService) validateReply(msg Message) error {
+	if msg.ReplyTo == "" {
+		return nil
+	}
+
+	parent, ok := cs.findMessage(msg.ReplyTo)
+	if !ok {
+		return errors.New("message " + msg.ReplyTo + " does not exist")
+	}
+	if ConversationID(parent.SenderID, parent.ReceiverID) != ConversationID(msg.SenderID, msg.ReceiverID) {
+		return errors.New("replies must stay within the conversation of the original message")
+	}
+	return nil
+}
+
+// ValidateReply checks that a reply refers to an existing message of the same conversation
+func (cs *ChatService) ValidateReply(msg Message) error {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.validateReply(msg)
+}
+
+// withReplyCounts fills in ReplyCount for each of the given messages
+func (cs *ChatService) withReplyCounts(msgs []Message) []Message {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	for i := range msgs {
+		msgs[i].ReplyCount = len(cs.replies[msgs[i].ID])
+	}
+	return msgs
+}
+
+// GetThread returns the root message and all replies below it, directly or
+// through other replies, in the order they were sent.
+func (cs *ChatService) GetThread(rootID string) ([]Message, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	rootPos, ok := cs.byID[rootID]
+	if !ok {
+		return nil, false
+	}
+
+	// Walk the reply tree breadth first, then restore send order
+	positions := []int{rootPos}
+	for i := 0; i < len(positions); i++ {
+		positions = append(positions, cs.replies[cs.messages[positions[i]].ID]...)
+	}
+	sort.Ints(positions)
+	return cs.messagesAt(positions), true
+}
+
+// GetConversation returns all messages exchanged between two users
+func (cs *ChatService) GetConversation(userA, userB string) []Message {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.messagesAt(cs.byConversation[ConversationID(userA, userB)])
+}
+
+// participantProblem checks that claims belong to an admin or to one of the
+// participants whose messages are read. It returns nil if they do.
+func (cs *ChatService) participantProblem(claims *Claims, participants ...string) *Problem {
+	if claims == nil {
+		return NewProblem(http.StatusUnauthorized, "A valid JWT is required in the Authorization header")
+	}
+	if claims.Role == "admin" {
+		return nil
+	}
+	callerID, found := cs.UserIDByName(claims.Username)
+	if !found {
+		return NewProblem(http.StatusNotFound, "User not found")
+	}
+	if slices.Contains(participants, callerID) {
+		return nil
+	}
+	return NewProblem(http.StatusForbidden, "Only participants can read these messages")
+}
+
+// requireParticipant lets a request through if its JWT belongs to an admin or to one
+// of the participants whose messages it reads. Otherwise it answers the request itself.
+func (cs *ChatService) requireParticipant(w http.ResponseWriter, r *http.Request, participants ...string) bool {
+	claims, _ := ClaimsFromRequest(r)
+	if p := cs.participantProblem(claims, participants...); p != nil {
+		WriteProblem(w, r, p)
+		return false
+	}
+	return true
+}
+
+// HTTP Handlers
+
+// GetThreadHandler returns a message and the whole thread of replies below it.
+// Only the two users of the conversation and admins may read it.
+func (cs *ChatService) GetThreadHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := ClaimsFromRequest(r); err != nil {
+		WriteProblem(w, r, NewProblem(http.StatusUnauthorized, "A valid JWT is required in the Authorization header"))
+		return
+	}
+	thread, ok := cs.GetThread(mux.Vars(r)["id"])
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusNotFound, "Message not found"))
+		return
+	}
+	if !cs.requireParticipant(w, r, thread[0].SenderID, thread[0].ReceiverID) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(linkPreviews.Attach(cs.withReplyCounts(thread)))
+}
+
+// GetConversationHandler returns the messages of a conversation, given as user1:user2.
+// Only the two users and admins may read it.
+func (cs *ChatService) GetConversationHandler(w http.ResponseWriter, r *http.Request) {
+	userA, userB, ok := strings.Cut(mux.Vars(r)["id"], ":")
+	if !ok {
+		WriteProblem(w, r, NewProblem(http.StatusBadRequest, "Conversation ID must look like user1:user2"))
+		return
+	}
+	if !cs.requireParticipant(w, r, userA, userB) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(linkPreviews.Attach(cs.withReplyCounts(cs.GetConversation(userA, userB))))
+}
@@ -5,10 +5,40 @@ import "time"
 // Message represents a chat message exchanged between users.
 // It contains information about the sender, receiver, message content, and timestamp.
 type Message struct {
-	SenderID   string    // ID of the user sending the message
-	ReceiverID string    // ID of the user receiving the message
-	Message    string    // The content of the message
+	ID         string    // Server assigned ID of the message
+	SenderID   string    `validate:"required"` // ID of the user sending the message
+	ReceiverID string    `validate:"required"` // ID of the user receiving the message
+	Message    string    // The content of the message, at most maxMessageLength characters
 	TimeStamp  time.Time // The time when the message was sent
+	ReplyTo    string    `json:",omitempty"` // ID of the message this one replies to
+	ReplyCount int       `json:",omitempty"` // Number of direct replies, filled in when messages are read
+	PollID     string    `json:",omitempty"` // Set if the message is a poll, its content lists the question and options
+	Deleted    bool      `json:",omitempty"` // Set if an admin deleted the message; it stays as an empty placeholder for its replies
+
+	Previews []LinkPreview `json:",omitempty"` // Previews of links in the message, filled in when messages are read
+
+	// End-to-end encrypted messages leave Message empty. The server stores and relays
+	// the ciphertext and key envelopes without being able to read them.
+	Ciphertext []byte        `json:",omitempty"` // Encrypted message content
+	Envelopes  []KeyEnvelope `json:",omitempty"` // Message key wrapped for each recipient device
+}
+
+// KeyEnvelope carries the key of an encrypted message, wrapped with the public key
+// of one recipient device.
+type KeyEnvelope struct {
+	RecipientID string // ID of the user owning the device
+	DeviceID    string // Device whose public key wrapped the message key
+	WrappedKey  []byte // The encrypted message key
+}
+
+// DeviceKey is a public key published by one of a user's devices.
+type DeviceKey struct {
+	UserID    string    // ID of the user owning the device
+	DeviceID  string    // Client chosen device identifier
+	Algorithm string    // Key algorithm, e.g. "x25519"
+	PublicKey []byte    // The public key itself
+	Version   int       // Incremented every time the device rotates its key
+	CreatedAt time.Time // When this version of the key was published
 }
 
 // ChatUser represents a user in the chat system with associated internal and security details.
@@ -17,11 +47,14 @@ type ChatUser struct {
 	InternData   User   // Internal user data such as ID and name
 	Password     string // Password for user authentication (should be securely hashed in real scenarios)
 	HashPassword string // Hashed password for secure comparison and authentication (useful for hierarchical systems)
+	Role         string // Role of the user, e.g. "user", "admin" or "bot"
 }
 
 // User represents a basic user structure with an ID and name.
 // It is used for identifying users and can be serialized to/from JSON format.
 type User struct {
-	ID   string `json:"id"`   // Unique identifier for the user
-	Name string `json:"name"` // Name of the user
+	ID        string    `json:"id" validate:"required,max=64"`             // Unique identifier for the user, a ULID assigned by the server
+	Name      string    `json:"name" validate:"required,max=64,nocontrol"` // Name of the user
+	CreatedAt time.Time `json:"created_at"`                                // When the user was created, set by the server
+	Version   int       `json:"version"`                                   // Incremented with every update, set by the server
 }
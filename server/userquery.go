@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUserPageSize = 50  // Page size when no limit is given
+	maxUserPageSize     = 200 // Upper bound for limit
+)
+
+// userSortFields are the fields users can be sorted by, with their comparison
+var userSortFields = map[string]func(a, b User) int{
+	"id":         func(a, b User) int { return compareIDs(a.ID, b.ID) },
+	"name":       func(a, b User) int { return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) },
+	"created_at": func(a, b User) int { return a.CreatedAt.Compare(b.CreatedAt) },
+}
+
+// compareIDs orders numeric IDs by value and everything else as text
+func compareIDs(a, b string) int {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// sortKey is one field of a sort order
+type sortKey struct {
+	Field string
+	Desc  bool
+}
+
+// UserQuery selects, orders and pages the users returned by GetUsers.
+type UserQuery struct {
+	ID            string    // Exact ID
+	Name          string    // Exact name, ignoring case
+	Prefix        string    // Start of the name, ignoring case
+	CreatedAfter  time.Time // Only users created after this
+	CreatedBefore time.Time // Only users created before this
+	Sort          []sortKey // Sort order, ties are broken by ID
+	Limit         int
+	Offset        int
+	After         *User // Set for cursor pagination: the last user of the previous page
+
+	sort string // Sort parameter as given, carried along in cursors and links
+}
+
+// userCursor is the decoded form of an opaque pagination cursor
+type userCursor struct {
+	Sort string `json:"s"`
+	User User   `json:"u"`
+}
+
+// ParseUserQuery reads a UserQuery from the query string of a GET /users request:
+//
+//	id=, name=          exact match (name ignoring case)
+//	q=                  prefix search on name, ignoring case
+//	created_after=, created_before=   RFC 3339 timestamps
+//	sort=name,-created_at             comma separated fields, - for descending
+//	limit=, offset=     offset pagination
+//	cursor=             cursor pagination, taken from the Link header of the previous page
+func ParseUserQuery(values url.Values) (UserQuery, error) {
+	q := UserQuery{
+		ID:     values.Get("id"),
+		Name:   values.Get("name"),
+		Prefix: values.Get("q"),
+		Limit:  defaultUserPageSize,
+		sort:   values.Get("sort"),
+	}
+
+	for param, target := range map[string]*time.Time{"created_after": &q.CreatedAfter, "created_before": &q.CreatedBefore} {
+		if value := values.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return UserQuery{}, errors.New(param + " must be an RFC 3339 timestamp")
+			}
+			*target = t
+		}
+	}
+
+	if q.sort != "" {
+		seen := make(map[string]bool)
+		for _, field := range strings.Split(q.sort, ",") {
+			key := sortKey{Field: strings.TrimSpace(field)}
+			if strings.HasPrefix(key.Field, "-") {
+				key.Field, key.Desc = key.Field[1:], true
+			}
+			if _, ok := userSortFields[key.Field]; !ok || seen[key.Field] {
+				return UserQuery{}, errors.New("Can't sort by " + field)
+			}
+			seen[key.Field] = true
+			q.Sort = append(q.Sort, key)
+		}
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			return UserQuery{}, errors.New("limit must be between 1 and " + strconv.Itoa(maxUserPageSize))
+		}
+		q.Limit = limit
+	}
+	if value := values.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return UserQuery{}, errors.New("offset must not be negative")
+		}
+		q.Offset = offset
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		if values.Get("offset") != "" {
+			return UserQuery{}, errors.New("Use either offset or cursor, not both")
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		var cursor userCursor
+		if err != nil || json.Unmarshal(raw, &cursor) != nil {
+			return UserQuery{}, errors.New("Invalid cursor")
+		}
+		if cursor.Sort != q.sort {
+			return UserQuery{}, errors.New("The cursor belongs to a different sort order")
+		}
+		q.After = &cursor.User
+	}
+	return q, nil
+}
+
+// matches reports whether a user passes the filters of the query
+func (q UserQuery) matches(user User) bool {
+	return (q.ID == "" || user.ID == q.ID) &&
+		(q.Name == "" || strings.EqualFold(user.Name, q.Name)) &&
+		(q.Prefix == "" || strings.HasPrefix(strings.ToLower(user.Name), strings.ToLower(q.Prefix))) &&
+		(q.CreatedAfter.IsZero() || user.CreatedAt.After(q.CreatedAfter)) &&
+		(q.CreatedBefore.IsZero() || user.CreatedAt.Before(q.CreatedBefore))
+}
+
+// compare orders two users by the sort order of the query, then by ID
+func (q UserQuery) compare(a, b User) int {
+	for _, key := range q.Sort {
+		if c := userSortFields[key.Field](a, b); c != 0 {
+			if key.Desc {
+				return -c
+			}
+			return c
+		}
+	}
+	return compareIDs(a.ID, b.ID)
+}
+
+// Apply filters and sorts all users and cuts out the requested page. It returns
+// the page, the number of users matching the filters and the cursor of the next
+// page, which is empty on the last page.
+func (q UserQuery) Apply(all []User) ([]User, int, string) {
+	matching := make([]User, 0, len(all))
+	for _, user := range all {
+		if q.matches(user) {
+			matching = append(matching, user)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return q.compare(matching[i], matching[j]) < 0 })
+	total := len(matching)
+
+	start := q.Offset
+	if q.After != nil {
+		start = sort.Search(len(matching), func(i int) bool { return q.compare(matching[i], *q.After) > 0 })
+	}
+	if start > len(matching) {
+		start = len(matching)
+	}
+	end := start + q.Limit
+	if end > len(matching) {
+		end = len(matching)
+	}
+	page := matching[start:end]
+
+	next := ""
+	if end < len(matching) && len(page) > 0 {
+		raw, _ := json.Marshal(userCursor{Sort: q.sort, User: page[len(page)-1]})
+		next = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return page, total, next
+}
+
+// Links builds the Link header for a page. Offset pages link to the first,
+// previous, next and last page; cursor pages only to the first and next one.
+func (q UserQuery) Links(u *url.URL, total int, next string) string {
+	link := func(rel string, set map[string]string) string {
+		values := u.Query()
+		values.Del("offset")
+		values.Del("cursor")
+		for key, value := range set {
+			values.Set(key, value)
+		}
+		return "<" + u.Path + "?" + values.Encode() + `>; rel="` + rel + `"`
+	}
+
+	links := []string{link("first", nil)}
+	if q.After != nil {
+		if next != "" {
+			links = append(links, link("next", map[string]string{"cursor": next}))
+		}
+		return strings.Join(links, ", ")
+	}
+
+	if q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", map[string]string{"offset": strconv.Itoa(prev)}))
+	}
+	if q.Offset+q.Limit < total {
+		links = append(links, link("next", map[string]string{"offset": strconv.Itoa(q.Offset + q.Limit)}))
+	}
+	if total > 0 {
+		last := (total - 1) / q.Limit * q.Limit
+		links = append(links, link("last", map[string]string{"offset": strconv.Itoa(last)}))
+	}
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned by a UserRepository
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrUserExists      = errors.New("a user with this id already exists")
+	ErrNameTaken       = errors.New("this name is already taken")
+	ErrVersionConflict = errors.New("the user was changed by someone else")
+)
+
+// UserRepository stores the users of the whole server. The REST API, the chat and
+// the browser pages all go through it, so a user created anywhere exists everywhere.
+// Names are unique, ignoring case.
+type UserRepository interface {
+	Create(user ChatUser) error
+	Get(id string) (ChatUser, error)
+	GetByName(name string) (ChatUser, error)
+	// Update replaces a user, but only if the stored version still is expectedVersion
+	Update(user ChatUser, expectedVersion int) error
+	Delete(id string) error
+	List() ([]ChatUser, error)
+}
+
+// userRepo is the repository every handler uses. main switches it to the SQL
+// implementation when a database is connected.
+var userRepo UserRepository = NewMemoryUserRepository()
+
+// nameKey normalizes a user name for the case-insensitive name index
+func nameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// CheckPassword reports whether password matches the stored hash of the user.
+// Users without a password, like bots, can't log in.
+func CheckPassword(user ChatUser, password string) bool {
+	if user.HashPassword == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.HashPassword), []byte(password)) == nil
+}
+
+// MemoryUserRepository is a UserRepository that forgets everything on restart.
+type MemoryUserRepository struct {
+	mu     sync.RWMutex
+	byID   map[string]ChatUser
+	byName map[string]string // Lower case name -> user ID
+}
+
+// NewMemoryUserRepository creates an empty MemoryUserRepository
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		byID:   make(map[string]ChatUser),
+		byName: make(map[string]string),
+	}
+}
+
+// Create implements UserRepository
+func (m *MemoryUserRepository) Create(user ChatUser) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.byID[user.InternData.ID]; exists {
+		return ErrUserExists
+	}
+	if _, taken := m.byName[nameKey(user.InternData.Name)]; taken {
+		return ErrNameTaken
+	}
+	m.byID[user.InternData.ID] = user
+	m.byName[nameKey(user.InternData.Name)] = user.InternData.ID
+	return nil
+}
+
+// Get implements UserRepository
+func (m *MemoryUserRepository) Get(id string) (ChatUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.byID[id]
+	if !ok {
+		return ChatUser{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// GetByName implements UserRepository
+func (m *MemoryUserRepository) GetByName(name string) (ChatUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, ok := m.byName[nameKey(name)]
+	if !ok {
+		return ChatUser{}, ErrUserNotFound
+	}
+	return m.byID[id], nil
+}
+
+// Update implements UserRepository
+func (m *MemoryUserRepository) Update(user ChatUser, expectedVersion int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := user.InternData.ID
+	old, ok := m.byID[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if old.InternData.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+	if owner, taken := m.byName[nameKey(user.InternData.Name)]; taken && owner != id {
+		return ErrNameTaken
+	}
+
+	delete(m.byName, nameKey(old.InternData.Name))
+	m.byID[id] = user
+	m.byName[nameKey(user.InternData.Name)] = id
+	return nil
+}
+
+// Delete implements UserRepository
+func (m *MemoryUserRepository) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.byID[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	delete(m.byID, id)
+	delete(m.byName, nameKey(user.InternData.Name))
+	return nil
+}
+
+// List implements UserRepository. Users are ordered by ID.
+func (m *MemoryUserRepository) List() ([]ChatUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]ChatUser, 0, len(m.byID))
+	for _, user := range m.byID {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].InternData.ID < list[j].InternData.ID })
+	return list, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+Validate checks a struct against the rules in the validate tags of its fields
+and returns the fields breaking them, named like in JSON. Rules are separated
+by commas:
+
+	required   the field must not be empty (blank strings count as empty)
+	min=n      strings have at least n characters, numbers are at least n
+	max=n      strings have at most n characters, numbers are at most n
+	nocontrol  strings must not contain control characters
+
+Fields without a validate tag are not checked.
+*/
+func Validate(v interface{}) []FieldError {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var errs []FieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ","); jsonName != "" && jsonName != "-" {
+			name = jsonName
+		}
+		for _, rule := range strings.Split(tag, ",") {
+			if msg := checkRule(value.Field(i), rule); msg != "" {
+				errs = append(errs, FieldError{Field: name, Message: msg})
+				break // One message per field is enough
+			}
+		}
+	}
+	return errs
+}
+
+// checkRule returns why value breaks rule, or "" if it doesn't
+func checkRule(value reflect.Value, rule string) string {
+	name, arg, _ := strings.Cut(rule, "=")
+	limit, _ := strconv.ParseFloat(arg, 64)
+
+	switch name {
+	case "required":
+		if value.IsZero() || (value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "") {
+			return "is required"
+		}
+	case "min", "max":
+		var size float64
+		unit := ""
+		switch value.Kind() {
+		case reflect.String:
+			size, unit = float64(utf8.RuneCountInString(value.String())), " characters"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			size = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			size = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			size = value.Float()
+		case reflect.Slice, reflect.Map:
+			size, unit = float64(value.Len()), " items"
+		}
+		if name == "min" && size < limit {
+			return "must be at least " + arg + unit
+		}
+		if name == "max" && size > limit {
+			return "must be at most " + arg + unit
+		}
+	case "nocontrol":
+		if value.Kind() == reflect.String && strings.IndexFunc(value.String(), unicode.IsControl) >= 0 {
+			return "must not contain control characters"
+		}
+	}
+	return ""
+}